@@ -0,0 +1,197 @@
+package iso9660
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path"
+	"time"
+)
+
+// Attributes holds the POSIX attributes of an entry, written to the image
+// when Rock Ridge extensions are enabled. ModTime is also recorded in the
+// directory records.
+type Attributes struct {
+	Mode    os.FileMode // permission bits, and type of special files
+	UID     uint32
+	GID     uint32
+	ModTime time.Time // defaults to the volume creation time if zero
+	Device  uint64    // device number of character and block devices
+}
+
+// ErrDirectoryEAR is returned when setting an Extended Attribute Record on a
+// directory, which is not supported
+var ErrDirectoryEAR = errors.New("extended attribute records can only be set on files")
+
+// default attributes for entries which had none set
+var (
+	defaultFileAttributes = Attributes{Mode: 0644}
+	defaultDirAttributes  = Attributes{Mode: os.ModeDir | 0755}
+)
+
+// SetAttributes sets the POSIX attributes of a file or directory previously
+// added to the image, including directories created implicitly by AddFile.
+func (iw *ImageWriter) SetAttributes(filePath string, attr Attributes) error {
+	item, err := iw.lookup(filePath)
+	if err != nil {
+		return err
+	}
+
+	item.meta().attr = &attr
+	return nil
+}
+
+// SetHidden sets whether a file or directory is hidden from directory
+// listings, keeping its other attributes
+func (iw *ImageWriter) SetHidden(filePath string, hidden bool) error {
+	return iw.setRecordFlag(filePath, dirFlagHidden, hidden)
+}
+
+// SetAssociated sets whether a file or directory is an associated file,
+// keeping its other attributes
+func (iw *ImageWriter) SetAssociated(filePath string, associated bool) error {
+	return iw.setRecordFlag(filePath, dirFlagAssociated, associated)
+}
+
+func (iw *ImageWriter) setRecordFlag(filePath string, flag byte, set bool) error {
+	item, err := iw.lookup(filePath)
+	if err != nil {
+		return err
+	}
+
+	if set {
+		item.meta().flags |= flag
+	} else {
+		item.meta().flags &^= flag
+	}
+	return nil
+}
+
+// SetExtendedAttributes sets the Extended Attribute Record recorded before
+// the contents of a file, or removes it if ear is nil. It can't be set on
+// directories.
+func (iw *ImageWriter) SetExtendedAttributes(filePath string, ear *ExtendedAttributeRecord) error {
+	item, err := iw.lookup(filePath)
+	if err != nil {
+		return err
+	}
+	if ear != nil && isDir(item) {
+		return ErrDirectoryEAR
+	}
+
+	item.meta().ear = ear
+	return nil
+}
+
+// AddSymlink adds a symbolic link pointing to target to the image. Symbolic
+// links can only be represented with Rock Ridge extensions.
+func (iw *ImageWriter) AddSymlink(target, filePath string) error {
+	if !iw.RockRidge {
+		return ErrRockRidgeRequired
+	}
+
+	item := &itemNode{target: target}
+	item.m.attr = &Attributes{Mode: os.ModeSymlink | 0777}
+	return iw.addItem(item, filePath)
+}
+
+// lookup returns the item found at the given (unmangled) path
+func (iw *ImageWriter) lookup(filePath string) (Item, error) {
+	segments := splitPath(path.Clean(filePath))
+	if len(segments) == 0 {
+		return iw.root, nil
+	}
+
+	pos := iw.root
+	for _, name := range segments[:len(segments)-1] {
+		sub, ok := pos.children[name].(*itemDir)
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		pos = sub
+	}
+
+	name := segments[len(segments)-1]
+	if item, ok := pos.children[name]; ok {
+		return item, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// attributes returns the attributes of an item, or the default ones
+func (wc *writeContext) attributes(it Item) Attributes {
+	var attr Attributes
+	switch {
+	case it.meta().attr != nil:
+		attr = *it.meta().attr
+	case isDir(it):
+		attr = defaultDirAttributes
+	default:
+		attr = defaultFileAttributes
+	}
+
+	if node, ok := it.(*itemNode); ok && node.target != "" {
+		attr.Mode |= os.ModeSymlink
+	}
+	if attr.ModTime.IsZero() {
+		attr.ModTime = time.Time(wc.timestamp)
+	}
+	if !wc.sourceDate.IsZero() {
+		// reproducible images don't depend on the time zone, and don't
+		// record changes made after their date
+		attr.ModTime = attr.ModTime.UTC()
+		if attr.ModTime.After(wc.sourceDate) {
+			attr.ModTime = wc.sourceDate
+		}
+	}
+	return attr
+}
+
+// attributesFromFileInfo returns the attributes of a local file
+func attributesFromFileInfo(st os.FileInfo) *Attributes {
+	attr := &Attributes{
+		Mode:    st.Mode(),
+		ModTime: st.ModTime(),
+	}
+	attr.UID, attr.GID, attr.Device = fileOwnership(st)
+	return attr
+}
+
+// recordFlags returns the flags of the directory records of an item set by
+// its attributes
+func (wc *writeContext) recordFlags(it Item) byte {
+	flags := it.meta().flags
+	if ear := it.meta().ear; ear != nil {
+		if ear.RecordFormat != 0 {
+			flags |= dirFlagRecord
+		}
+		if ear.Permissions&^earPermissionsReserved != 0 {
+			flags |= dirFlagProtection
+		}
+	}
+	return flags
+}
+
+// allocExtendedAttributes allocates the Extended Attribute Record of an
+// item, if any, returning its length in sectors
+func (wc *writeContext) allocExtendedAttributes(it Item) (byte, error) {
+	if it.meta().ear == nil {
+		return 0, nil
+	}
+
+	data, err := it.meta().ear.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	ear := &bufferHndlr{d: data}
+	if ear.sectors() > math.MaxUint8 {
+		return 0, errors.New("extended attribute record is too long")
+	}
+	wc.allocMetadata(ear)
+	return byte(ear.sectors()), nil
+}
+
+func isDir(it Item) bool {
+	_, ok := it.(*itemDir)
+	return ok
+}
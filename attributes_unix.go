@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package iso9660
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwnership returns the owner, group and device number of a local file
+func fileOwnership(st os.FileInfo) (uid, gid uint32, dev uint64) {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return sys.Uid, sys.Gid, uint64(sys.Rdev)
+	}
+	return 0, 0, 0
+}
@@ -3,75 +3,206 @@ package iso9660
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 )
 
 // ElTorito boot catalog
 // see: https://dev.lovelyhq.com/libburnia/libisofs/raw/master/doc/boot_sectors.txt
 
+// BootCatalogEntry is a boot image to be listed in the boot catalog of an
+// image. The first entry added is the initial/default entry, following
+// entries are grouped in sections by platform and section ID.
 type BootCatalogEntry struct {
 	Platform      ElToritoPlatform
 	BootMedia     ElToritoEmul // 0=NoEmul, 2=1.44MB disk, 4=HDD
 	BootInfoTable bool
-	file          Item
+
+	// LoadSegment is the segment no emulation images are loaded at by x86
+	// BIOSes, 0 meaning the traditional 0x7C0
+	LoadSegment uint16
+	// SystemType is the partition type of hard disk images. It is read from
+	// the partition table of the image's MBR if not set.
+	SystemType byte
+	// SectorCount is the number of 512-byte virtual sectors loaded. If not
+	// set, it is the size of the image for EFI, 4 for other no emulation
+	// images and 1 for emulated media.
+	SectorCount uint16
+	// NotBootable lists the image in the catalog without it being bootable
+	NotBootable bool
+	// SectionID is the ID string of the entry's section (up to 28 bytes), or
+	// the manufacturer ID of the validation entry for the first entry (up to
+	// 24 bytes)
+	SectionID string
+	// SelectionCriteriaType and SelectionCriteria are vendor unique selection
+	// criteria. They are not recorded for the first entry, and criteria
+	// longer than 19 bytes are continued in extension entries.
+	SelectionCriteriaType byte
+	SelectionCriteria     []byte
+
+	systemType byte // system type read from the image's MBR
+	file       Item
 }
 
-// encodeBootCatalogs must be called after prepareAll so that targetSector is
-// populated.
-func encodeBootCatalogs(e []*BootCatalogEntry) ([]byte, error) {
-	// transform a list of catalog entries into binary catalog
-	buf := &bytes.Buffer{}
+// ErrBootImageSize is returned when adding a floppy emulation boot image
+// whose size doesn't match the emulated floppy
+var ErrBootImageSize = errors.New("boot image size doesn't match the emulated floppy")
 
-	cnt := len(e)
-
-	for i, b := range e {
-		if i == 0 {
-			// Validation Entry
-			buf.Write([]byte{1, byte(b.Platform), 0, 0}) // 4 bytes
-			// manuf_dev
-			buf.Write(make([]byte, 24)) // 24 bytes
-			// checksum
-			buf.Write([]byte{0x00, 0x00}) // 2 bytes
-			// 0x55 0xaa (bootable)
-			buf.Write([]byte{0x55, 0xaa}) // 2 bytes
-
-			// compute checksum
-			v := doBootCatalogChecksum(buf.Bytes())
-			copy(buf.Bytes()[28:30], v)
-		} else {
-			// Section Header Entry
-			headInd := byte(0x90)
-			if i == cnt-1 {
-				headInd = 0x91
-			}
-			buf.Write([]byte{headInd, byte(b.Platform), 1, 0})
-			buf.Write(make([]byte, 28))
+// validate checks the entry and its image
+func (b *BootCatalogEntry) validate(data Item) error {
+	if len(b.SectionID) > 28 {
+		return fmt.Errorf("boot section ID %q is too long", b.SectionID)
+	}
+	if size := b.BootMedia.floppySize(); size != 0 && data.Size() != size {
+		return fmt.Errorf("%w: %d bytes instead of %d", ErrBootImageSize, data.Size(), size)
+	}
+	return nil
+}
+
+// readSystemType sets the system type of hard disk images from the first
+// partition found in the MBR of the image
+func (b *BootCatalogEntry) readSystemType(mbr []byte) error {
+	if len(mbr) < 512 || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return errors.New("hard disk boot image has no valid MBR")
+	}
+	for n := 0; n < 4; n++ {
+		if sysType := mbr[446+16*n+4]; sysType != 0 {
+			b.systemType = sysType
+			return nil
 		}
+	}
+	return errors.New("hard disk boot image has no partition")
+}
 
-		// Initial/Default Entry or Section Entry
-		buf.Write([]byte{0x88, byte(b.BootMedia), 0x00, 0x00}) // 4 bytes
-		buf.Write([]byte{0, 0})                                // 2 bytes: sys_type, unused
+// sectorCount returns the number of virtual sectors recorded for the entry
+func (b *BootCatalogEntry) sectorCount() uint16 {
+	switch {
+	case b.SectorCount != 0:
+		return b.SectorCount
+	case b.BootMedia != ElToritoNoEmul:
+		return 1
+	case b.Platform == ElToritoEFI:
+		// UEFI needs the file size
+		siz := b.file.Size()
+		sizSec := siz / 512
+		if siz%512 != 0 {
+			sizSec += 1
+		}
+		if sizSec > 0xffff {
+			return 0xffff
+		}
+		return uint16(sizSec)
+	default:
+		return 4
+	}
+}
 
-		// sec count depends if we are a uefi file or not (uefi needs file size)
-		if b.Platform == 0xef {
-			// UEFI
-			siz := b.file.Size()
-			sizSec := uint16(siz / 512)
-			if siz%512 != 0 {
-				sizSec += 1
-			}
+// encodeEntry returns the initial/default entry or section entry describing
+// b, followed by any section entry extension
+func (b *BootCatalogEntry) encodeEntry(section bool) []byte {
+	data := make([]byte, bootCatalogEntrySize)
+	data[0] = bootIndicatorBootable
+	if b.NotBootable {
+		data[0] = bootIndicatorNotBootable
+	}
+	data[1] = byte(b.BootMedia)
+	binary.LittleEndian.PutUint16(data[2:4], b.LoadSegment)
+	data[4] = b.SystemType
+	if data[4] == 0 {
+		data[4] = b.systemType
+	}
+	binary.LittleEndian.PutUint16(data[6:8], b.sectorCount())
+	binary.LittleEndian.PutUint32(data[8:12], b.file.meta().targetSector)
+
+	if !section {
+		return data
+	}
 
-			binary.Write(buf, binary.LittleEndian, sizSec) // 2 bytes
-		} else {
-			binary.Write(buf, binary.LittleEndian, uint16(4)) // 2 bytes
+	// Vendor unique selection criteria
+	data[12] = b.SelectionCriteriaType
+	criteria := b.SelectionCriteria[copy(data[13:], b.SelectionCriteria):]
+	if len(criteria) > 0 {
+		data[1] |= bootExtensionFollows
+	}
+
+	for len(criteria) > 0 {
+		ext := make([]byte, bootCatalogEntrySize)
+		ext[0] = bootExtensionIndicator
+		criteria = criteria[copy(ext[2:], criteria):]
+		if len(criteria) > 0 {
+			ext[1] = bootExtensionFollows
 		}
+		data = append(data, ext...)
+	}
+	return data
+}
+
+// bootSections groups entries in sections of the same platform and ID, in
+// order of first appearance
+func bootSections(e []*BootCatalogEntry) [][]*BootCatalogEntry {
+	var res [][]*BootCatalogEntry
+	index := make(map[[2]string]int)
+	for _, b := range e {
+		key := [2]string{string([]byte{byte(b.Platform)}), b.SectionID}
+		n, ok := index[key]
+		if !ok {
+			n = len(res)
+			index[key] = n
+			res = append(res, nil)
+		}
+		res[n] = append(res[n], b)
+	}
+	return res
+}
+
+// encodeBootCatalogs must be called after processAll so that targetSector is
+// populated. The size of the catalog doesn't depend on it.
+func encodeBootCatalogs(e []*BootCatalogEntry) ([]byte, error) {
+	// transform a list of catalog entries into binary catalog
+	buf := &bytes.Buffer{}
+	if len(e) == 0 {
+		return nil, nil
+	}
 
-		// load_rba
-		binary.Write(buf, binary.LittleEndian, uint32(b.file.meta().targetSector)) // 4 bytes
+	// Validation Entry
+	first := e[0]
+	if len(first.SectionID) > 24 {
+		return nil, fmt.Errorf("boot catalog ID %q is too long", first.SectionID)
+	}
+	validation := make([]byte, bootCatalogEntrySize)
+	validation[0] = 1
+	validation[1] = byte(first.Platform)
+	copy(validation[4:28], first.SectionID) // manuf_dev
+	validation[30], validation[31] = 0x55, 0xaa
+	// compute checksum
+	copy(validation[28:30], doBootCatalogChecksum(validation))
+	buf.Write(validation)
 
-		buf.Write(make([]byte, 20)) // "Vendor unique selection criteria."
+	// Initial/Default Entry
+	buf.Write(first.encodeEntry(false))
 
-		if b.BootInfoTable {
-			b.performInfoTable()
+	sections := bootSections(e[1:])
+	for i, section := range sections {
+		if len(section) > 0xffff {
+			return nil, errors.New("too many entries in boot catalog section")
+		}
+
+		// Section Header Entry
+		header := make([]byte, bootCatalogEntrySize)
+		header[0] = bootHeaderMore
+		if i == len(sections)-1 {
+			header[0] = bootHeaderFinal
+		}
+		header[1] = byte(section[0].Platform)
+		binary.LittleEndian.PutUint16(header[2:4], uint16(len(section)))
+		copy(header[4:], section[0].SectionID)
+		buf.Write(header)
+
+		// Section Entries
+		for _, b := range section {
+			buf.Write(b.encodeEntry(true))
 		}
 	}
 	return buf.Bytes(), nil
@@ -113,3 +244,246 @@ func (b *BootCatalogEntry) performInfoTable() {
 	binary.LittleEndian.PutUint32(f.d[16:20], uint32(f.Size()))                  // Boot file length in bytes
 	binary.LittleEndian.PutUint32(f.d[20:24], doElToritoTableChecksum(f.d[64:])) // 32bit checksum
 }
+
+const (
+	bootCatalogEntrySize = 32
+	// maxBootCatalogSize is the largest boot catalog read from an image
+	maxBootCatalogSize = 64 * sectorSize
+
+	bootIndicatorBootable    = 0x88
+	bootIndicatorNotBootable = 0x00
+	bootHeaderMore           = 0x90
+	bootHeaderFinal          = 0x91
+	bootExtensionIndicator   = 0x44
+	bootExtensionFollows     = 0x20 // in media type of entries and flags of extensions
+
+	elToritoSystemIdentifier = "EL TORITO SPECIFICATION"
+)
+
+// ErrNoBootCatalog is returned by Image.BootCatalog for images without El
+// Torito boot record
+var ErrNoBootCatalog = errors.New("no boot catalog")
+
+// BootCatalog is an El Torito boot catalog read from an image
+type BootCatalog struct {
+	Location uint32           // sector of the catalog
+	Platform ElToritoPlatform // platform of the validation entry
+	ID       string           // manufacturer ID of the validation entry
+	Sections []*BootSection   // the first section holds the initial/default entry
+}
+
+// BootSection is a section of a boot catalog. The first section of a catalog
+// is described by its validation entry.
+type BootSection struct {
+	Platform ElToritoPlatform
+	ID       string
+	Entries  []*BootEntry
+}
+
+// BootEntry is an entry of a boot catalog, describing a boot image
+type BootEntry struct {
+	Bootable    bool
+	Emulation   ElToritoEmul
+	LoadSegment uint16
+	SystemType  byte
+	SectorCount uint16 // number of 512-byte virtual sectors loaded
+	LoadRBA     uint32 // sector of the boot image
+
+	// SelectionCriteriaType and SelectionCriteria are the vendor unique
+	// selection criteria of section entries, including their extensions
+	SelectionCriteriaType byte
+	SelectionCriteria     []byte
+
+	ra io.ReaderAt
+}
+
+// BootCatalog reads the El Torito boot catalog of the image. It returns
+// ErrNoBootCatalog if the image has no El Torito boot record.
+func (i *Image) BootCatalog() (*BootCatalog, error) {
+	for _, vd := range i.volumeDescriptors {
+		if vd.Type() == volumeTypeBoot && vd.Boot.BootSystemIdentifier == elToritoSystemIdentifier {
+			location := binary.LittleEndian.Uint32(vd.Boot.BootSystemUse[:4])
+			return readBootCatalog(i.ra, location)
+		}
+	}
+	return nil, ErrNoBootCatalog
+}
+
+// bootCatalogReader reads the entries of a boot catalog one at a time
+type bootCatalogReader struct {
+	ra       io.ReaderAt
+	location uint32
+	buf      []byte
+	pos      int
+}
+
+func (r *bootCatalogReader) next() ([]byte, error) {
+	if r.pos == len(r.buf) {
+		if len(r.buf) >= int(maxBootCatalogSize) {
+			return nil, errors.New("boot catalog is too large")
+		}
+		sector := make([]byte, sectorSize)
+		if _, err := r.ra.ReadAt(sector, (int64(r.location)+int64(len(r.buf)/int(sectorSize)))*int64(sectorSize)); err != nil {
+			return nil, fmt.Errorf("reading boot catalog: %w", err)
+		}
+		r.buf = append(r.buf, sector...)
+	}
+
+	entry := r.buf[r.pos : r.pos+bootCatalogEntrySize]
+	r.pos += bootCatalogEntrySize
+	return entry, nil
+}
+
+// readBootCatalog reads and parses the boot catalog found at the given sector
+func readBootCatalog(ra io.ReaderAt, location uint32) (*BootCatalog, error) {
+	r := &bootCatalogReader{ra: ra, location: location}
+
+	// Validation Entry
+	data, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if data[0] != 1 || data[30] != 0x55 || data[31] != 0xaa {
+		return nil, errors.New("invalid boot catalog validation entry")
+	}
+	if sum := doBootCatalogChecksum(data); sum[0] != 0 || sum[1] != 0 {
+		return nil, errors.New("invalid boot catalog checksum")
+	}
+
+	catalog := &BootCatalog{
+		Location: location,
+		Platform: ElToritoPlatform(data[1]),
+		ID:       strings.TrimRight(string(data[4:28]), " \x00"),
+	}
+
+	// Initial/Default Entry
+	if data, err = r.next(); err != nil {
+		return nil, err
+	}
+	entry, err := r.parseEntry(data, false)
+	if err != nil {
+		return nil, err
+	}
+	catalog.Sections = append(catalog.Sections, &BootSection{
+		Platform: catalog.Platform,
+		ID:       catalog.ID,
+		Entries:  []*BootEntry{entry},
+	})
+
+	for {
+		// Section Header Entry
+		if data, err = r.next(); err != nil {
+			return nil, err
+		}
+		if data[0] != bootHeaderMore && data[0] != bootHeaderFinal {
+			// no more sections
+			break
+		}
+
+		indicator := data[0]
+		section := &BootSection{
+			Platform: ElToritoPlatform(data[1]),
+			ID:       strings.TrimRight(string(data[4:32]), " \x00"),
+		}
+		count := int(binary.LittleEndian.Uint16(data[2:4]))
+		for n := 0; n < count; n++ {
+			if data, err = r.next(); err != nil {
+				return nil, err
+			}
+			if entry, err = r.parseEntry(data, true); err != nil {
+				return nil, err
+			}
+			section.Entries = append(section.Entries, entry)
+		}
+		catalog.Sections = append(catalog.Sections, section)
+
+		if indicator == bootHeaderFinal {
+			break
+		}
+	}
+
+	return catalog, nil
+}
+
+// parseEntry parses an initial/default entry or a section entry, along with
+// any extension of section entries
+func (r *bootCatalogReader) parseEntry(data []byte, section bool) (*BootEntry, error) {
+	if data[0] != bootIndicatorBootable && data[0] != bootIndicatorNotBootable {
+		return nil, fmt.Errorf("invalid boot indicator 0x%02x", data[0])
+	}
+
+	entry := &BootEntry{
+		Bootable:    data[0] == bootIndicatorBootable,
+		Emulation:   ElToritoEmul(data[1] & 0x0f),
+		LoadSegment: binary.LittleEndian.Uint16(data[2:4]),
+		SystemType:  data[4],
+		SectorCount: binary.LittleEndian.Uint16(data[6:8]),
+		LoadRBA:     binary.LittleEndian.Uint32(data[8:12]),
+		ra:          r.ra,
+	}
+	if !section {
+		return entry, nil
+	}
+
+	entry.SelectionCriteriaType = data[12]
+	entry.SelectionCriteria = append([]byte(nil), data[13:32]...)
+
+	for more := data[1]&bootExtensionFollows != 0; more; {
+		ext, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if ext[0] != bootExtensionIndicator {
+			return nil, fmt.Errorf("invalid boot entry extension indicator 0x%02x", ext[0])
+		}
+		entry.SelectionCriteria = append(entry.SelectionCriteria, ext[2:32]...)
+		more = ext[1]&bootExtensionFollows != 0
+	}
+	return entry, nil
+}
+
+// Size returns the size in bytes of the boot image: the size of the emulated
+// floppy, the end of the last partition of an emulated hard disk, or the
+// number of virtual sectors loaded for images without emulation
+func (e *BootEntry) Size() int64 {
+	if size := e.Emulation.floppySize(); size != 0 {
+		return size
+	}
+	if e.Emulation == ElToritoHDD {
+		if size := e.diskSize(); size > 0 {
+			return size
+		}
+	}
+	return int64(e.SectorCount) * 512
+}
+
+// diskSize returns the size of an emulated hard disk image, according to the
+// partition table of its master boot record, or 0
+func (e *BootEntry) diskSize() int64 {
+	mbr := make([]byte, 512)
+	if _, err := e.ra.ReadAt(mbr, int64(e.LoadRBA)*int64(sectorSize)); err != nil {
+		return 0
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return 0
+	}
+
+	var end int64
+	for n := 0; n < 4; n++ {
+		part := mbr[446+16*n : 446+16*(n+1)]
+		if part[4] == 0 {
+			continue
+		}
+		partEnd := int64(binary.LittleEndian.Uint32(part[8:12])) + int64(binary.LittleEndian.Uint32(part[12:16]))
+		if partEnd > end {
+			end = partEnd
+		}
+	}
+	return end * 512
+}
+
+// Reader returns a reader over the boot image, as geteltorito would extract
+// it
+func (e *BootEntry) Reader() io.Reader {
+	return io.NewSectionReader(e.ra, int64(e.LoadRBA)*int64(sectorSize), e.Size())
+}
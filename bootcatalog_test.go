@@ -0,0 +1,271 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootCatalogRoundTrip(t *testing.T) {
+	bios := make([]byte, 4096)
+	efi := bytes.Repeat([]byte("EFI!"), 750)
+
+	biosItem, err := NewItemReader(bytes.NewReader(bios))
+	assert.NoError(t, err)
+	efiItem, err := NewItemReader(bytes.NewReader(efi))
+	assert.NoError(t, err)
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{BootInfoTable: true}, biosItem, "isolinux/isolinux.bin"))
+	assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{Platform: ElToritoEFI}, efiItem, "efi.img"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	catalog, err := image.BootCatalog()
+	if !assert.NoError(t, err) {
+		return
+	}
+	cat, err := image.Lookup("BOOT.CAT")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(cat.de.ExtentLocation), catalog.Location)
+	assert.Equal(t, ElToritoX86, catalog.Platform)
+
+	if !assert.Len(t, catalog.Sections, 2) {
+		return
+	}
+	entry := catalog.Sections[0].Entries[0]
+	f, err := image.Lookup("isolinux/isolinux.bin")
+	assert.NoError(t, err)
+	assert.True(t, entry.Bootable)
+	assert.Equal(t, ElToritoNoEmul, entry.Emulation)
+	assert.Equal(t, uint16(4), entry.SectorCount)
+	assert.Equal(t, uint32(f.de.ExtentLocation), entry.LoadRBA)
+
+	assert.Equal(t, ElToritoEFI, catalog.Sections[1].Platform)
+	entry = catalog.Sections[1].Entries[0]
+	assert.Equal(t, uint16(6), entry.SectorCount)
+	assert.Equal(t, int64(3072), entry.Size())
+	data, err := ioutil.ReadAll(entry.Reader())
+	assert.NoError(t, err)
+	assert.Equal(t, efi, data[:len(efi)])
+}
+
+// buildBootTestImage returns an image with no volume but a boot record
+// pointing to the given catalog at sector 20, followed by the given sectors
+func buildBootTestImage(t *testing.T, catalog []byte, sectors ...[]byte) []byte {
+	image := make([]byte, 20*sectorSize)
+
+	boot := &volumeDescriptor{
+		Header: volumeDescriptorHeader{Type: volumeTypeBoot, Identifier: standardIdentifierBytes, Version: 1},
+		Boot:   &BootVolumeDescriptorBody{BootSystemIdentifier: elToritoSystemIdentifier},
+	}
+	binary.LittleEndian.PutUint32(boot.Boot.BootSystemUse[:4], 20)
+	terminator := &volumeDescriptor{
+		Header: volumeDescriptorHeader{Type: volumeTypeTerminator, Identifier: standardIdentifierBytes, Version: 1},
+	}
+	for n, vd := range []*volumeDescriptor{boot, terminator} {
+		data, err := vd.MarshalBinary()
+		assert.NoError(t, err)
+		copy(image[(16+n)*int(sectorSize):], data)
+	}
+
+	for _, data := range append([][]byte{catalog}, sectors...) {
+		sector := make([]byte, sectorSize)
+		copy(sector, data)
+		image = append(image, sector...)
+	}
+	return image
+}
+
+func TestImageBootCatalog(t *testing.T) {
+	validation := make([]byte, 32)
+	validation[0] = 1
+	copy(validation[4:], "VENDOR")
+	validation[30], validation[31] = 0x55, 0xaa
+	copy(validation[28:30], doBootCatalogChecksum(validation))
+
+	entry := func(indicator, media byte, segment uint16, sysType byte, count uint16, rba uint32) []byte {
+		data := make([]byte, 32)
+		data[0], data[1], data[4] = indicator, media, sysType
+		binary.LittleEndian.PutUint16(data[2:4], segment)
+		binary.LittleEndian.PutUint16(data[6:8], count)
+		binary.LittleEndian.PutUint32(data[8:12], rba)
+		return data
+	}
+	header := func(indicator byte, platform ElToritoPlatform, count uint16, id string) []byte {
+		data := make([]byte, 32)
+		data[0], data[1] = indicator, byte(platform)
+		binary.LittleEndian.PutUint16(data[2:4], count)
+		copy(data[4:], id)
+		return data
+	}
+
+	criteria := entry(0x88, 0x20, 0, 0, 8, 22)
+	criteria[12] = 1
+	copy(criteria[13:], "first")
+	extension := make([]byte, 32)
+	extension[0] = 0x44
+	copy(extension[2:], "second")
+
+	catalog := concatBytes(
+		validation,
+		entry(0x88, byte(ElToritoHDD), 0x7c0, 0x0c, 1, 21),
+		header(0x90, ElToritoEFI, 2, "efi"),
+		criteria, extension,
+		entry(0x00, 0, 0, 0, 4, 23),
+		header(0x91, ElToritoPPC, 1, ""),
+		entry(0x88, byte(ElToritoFloppy144), 0, 0, 1, 24),
+	)
+
+	mbr := make([]byte, 512)
+	copy(mbr[446:], []byte{0x80, 0, 0, 0, 0x0c, 0, 0, 0, 1, 0, 0, 0, 63, 0, 0, 0})
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	image, err := OpenImage(bytes.NewReader(buildBootTestImage(t, catalog, mbr)))
+	assert.NoError(t, err)
+
+	res, err := image.BootCatalog()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "VENDOR", res.ID)
+	if !assert.Len(t, res.Sections, 3) {
+		return
+	}
+
+	assert.Equal(t, &BootSection{Platform: ElToritoX86, ID: "VENDOR", Entries: []*BootEntry{
+		{Bootable: true, Emulation: ElToritoHDD, LoadSegment: 0x7c0, SystemType: 0x0c, SectorCount: 1, LoadRBA: 21, ra: image.ra},
+	}}, res.Sections[0])
+	assert.Equal(t, int64(64*512), res.Sections[0].Entries[0].Size())
+
+	assert.Equal(t, ElToritoEFI, res.Sections[1].Platform)
+	assert.Equal(t, "efi", res.Sections[1].ID)
+	if assert.Len(t, res.Sections[1].Entries, 2) {
+		e := res.Sections[1].Entries[0]
+		assert.Equal(t, byte(1), e.SelectionCriteriaType)
+		assert.Equal(t, "first", string(bytes.TrimRight(e.SelectionCriteria[:19], "\x00")))
+		assert.Equal(t, "second", string(bytes.TrimRight(e.SelectionCriteria[19:], "\x00")))
+		assert.Len(t, e.SelectionCriteria, 19+30)
+		assert.False(t, res.Sections[1].Entries[1].Bootable)
+	}
+
+	assert.Equal(t, ElToritoPPC, res.Sections[2].Platform)
+	assert.Equal(t, int64(1440*1024), res.Sections[2].Entries[0].Size())
+
+	// the catalog ends with the final section, whatever follows
+	padded := concatBytes(catalog, bytes.Repeat([]byte{0x91, 0x55}, 64))
+	image, err = OpenImage(bytes.NewReader(buildBootTestImage(t, padded, mbr)))
+	assert.NoError(t, err)
+	res, err = image.BootCatalog()
+	if assert.NoError(t, err) {
+		assert.Len(t, res.Sections, 3)
+	}
+
+	// corrupted validation entry
+	validation[4] = 'X'
+	image, err = OpenImage(bytes.NewReader(buildBootTestImage(t, concatBytes(validation, entry(0x88, 0, 0, 0, 4, 21)))))
+	assert.NoError(t, err)
+	_, err = image.BootCatalog()
+	assert.EqualError(t, err, "invalid boot catalog checksum")
+
+	// no boot record
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+	image, err = OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	_, err = image.BootCatalog()
+	assert.Equal(t, ErrNoBootCatalog, err)
+}
+
+func TestWriterBootCatalog(t *testing.T) {
+	item := func(data []byte) Item {
+		res, err := NewItemReader(bytes.NewReader(data))
+		assert.NoError(t, err)
+		return res
+	}
+
+	disk := make([]byte, 64*512)
+	copy(disk[446:], []byte{0x80, 0, 0, 0, 0x0e, 0, 0, 0, 1, 0, 0, 0, 63, 0, 0, 0})
+	disk[510], disk[511] = 0x55, 0xaa
+	criteria := bytes.Repeat([]byte{'c'}, 40)
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	for _, entry := range []struct {
+		boot *BootCatalogEntry
+		data []byte
+		path string
+	}{
+		{&BootCatalogEntry{LoadSegment: 0x7c0, SectorCount: 8, SectionID: "VENDOR"}, make([]byte, 4096), "bios.bin"},
+		{&BootCatalogEntry{BootMedia: ElToritoHDD}, disk, "disk.img"},
+		{&BootCatalogEntry{Platform: ElToritoEFI, SectionID: "UEFI"}, make([]byte, 1000), "efi/a.img"},
+		{&BootCatalogEntry{Platform: ElToritoEFI, SectionID: "UEFI", SelectionCriteriaType: 1, SelectionCriteria: criteria}, make([]byte, 2000), "efi/b.img"},
+		{&BootCatalogEntry{NotBootable: true}, make([]byte, 2048), "other.bin"},
+		{&BootCatalogEntry{BootMedia: ElToritoFloppy144}, make([]byte, 1440*1024), "floppy.img"},
+	} {
+		assert.NoError(t, w.AddBootEntry(entry.boot, item(entry.data), entry.path))
+	}
+
+	// floppies must have the right size
+	err = w.AddBootEntry(&BootCatalogEntry{BootMedia: ElToritoFloppy288}, item(make([]byte, 1440*1024)), "bad.img")
+	assert.True(t, errors.Is(err, ErrBootImageSize))
+	// hard disk images need a partition table
+	assert.Error(t, w.AddBootEntry(&BootCatalogEntry{BootMedia: ElToritoHDD}, item(make([]byte, 1024)), "bad.img"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	catalog, err := image.BootCatalog()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rba := func(name string) uint32 {
+		f, err := image.Lookup(name)
+		assert.NoError(t, err)
+		return uint32(f.de.ExtentLocation)
+	}
+
+	assert.Equal(t, "VENDOR", catalog.ID)
+	if !assert.Len(t, catalog.Sections, 3) {
+		return
+	}
+	assert.Equal(t, &BootEntry{Bootable: true, LoadSegment: 0x7c0, SectorCount: 8, LoadRBA: rba("bios.bin"), ra: image.ra}, catalog.Sections[0].Entries[0])
+
+	// all x86 entries share a section
+	assert.Equal(t, ElToritoX86, catalog.Sections[1].Platform)
+	if assert.Len(t, catalog.Sections[1].Entries, 3) {
+		e := catalog.Sections[1].Entries
+		assert.Equal(t, ElToritoHDD, e[0].Emulation)
+		assert.Equal(t, byte(0x0e), e[0].SystemType)
+		assert.Equal(t, uint16(1), e[0].SectorCount)
+		assert.Equal(t, int64(len(disk)), e[0].Size())
+		assert.False(t, e[1].Bootable)
+		assert.Equal(t, rba("other.bin"), e[1].LoadRBA)
+		assert.Equal(t, ElToritoFloppy144, e[2].Emulation)
+	}
+
+	assert.Equal(t, ElToritoEFI, catalog.Sections[2].Platform)
+	assert.Equal(t, "UEFI", catalog.Sections[2].ID)
+	if assert.Len(t, catalog.Sections[2].Entries, 2) {
+		e := catalog.Sections[2].Entries
+		assert.Equal(t, uint16(2), e[0].SectorCount)
+		assert.Equal(t, uint16(4), e[1].SectorCount)
+		assert.Equal(t, byte(1), e[1].SelectionCriteriaType)
+		assert.Equal(t, criteria, e[1].SelectionCriteria[:len(criteria)])
+		assert.Equal(t, rba("efi/b.img"), e[1].LoadRBA)
+	}
+}
@@ -1,39 +1,74 @@
 package iso9660
 
-import "bytes"
+import (
+	"bytes"
+	"sort"
+)
 
 type itemDir struct {
 	children map[string]Item
+	names    map[string]string   // original names of children, before mangling
+	su       map[string][][]byte // System Use entries of each record, if any
 	buf      *bytes.Buffer
+	r        *bytes.Reader // reads buf, until closed
 	m        itemMeta
 }
 
 func newDir() *itemDir {
 	res := &itemDir{
 		children: make(map[string]Item),
+		names:    make(map[string]string),
 		buf:      &bytes.Buffer{},
 	}
 	return res
 }
 
 func (d *itemDir) Read(p []byte) (int, error) {
-	return d.buf.Read(p)
+	if d.r == nil {
+		d.r = bytes.NewReader(d.buf.Bytes())
+	}
+	return d.r.Read(p)
+}
+
+// sortedNames returns the identifiers of the directory's children in the
+// order they are written to disk
+func (d *itemDir) sortedNames() []string {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordLength returns the length of the directory record with the given
+// identifier, including its System Use field
+func (d *itemDir) recordLength(name string) uint32 {
+	identifierLen := len(name)
+	idPaddingLen := (identifierLen + 1) % 2
+	entryLength := uint32(33 + identifierLen + idPaddingLen)
+	if d.su != nil {
+		entryLength += uint32(systemUseLength(d.su[name], identifierLen))
+	}
+	return entryLength
 }
 
 func (d *itemDir) sectors() uint32 {
 	var sectors uint32
-	var currentSectorOccupied uint32 = 68 // the 0x00 and 0x01 entries
+	// the 0x00 and 0x01 entries
+	currentSectorOccupied := d.recordLength(string([]byte{0})) + d.recordLength(string([]byte{1}))
 
-	for name := range d.children {
-		identifierLen := len(name)
-		idPaddingLen := (identifierLen + 1) % 2
-		entryLength := uint32(33 + identifierLen + idPaddingLen)
-
-		if currentSectorOccupied+entryLength > sectorSize {
-			sectors += 1
-			currentSectorOccupied = entryLength
-		} else {
-			currentSectorOccupied += entryLength
+	for _, name := range d.sortedNames() {
+		entryLength := d.recordLength(name)
+
+		// files larger than an extent have one record per section
+		for n := sectionCount(d.children[name].Size()); n > 0; n-- {
+			if currentSectorOccupied+entryLength > sectorSize {
+				sectors += 1
+				currentSectorOccupied = entryLength
+			} else {
+				currentSectorOccupied += entryLength
+			}
 		}
 	}
 
@@ -49,9 +84,14 @@ func (d *itemDir) Size() int64 {
 }
 
 func (d *itemDir) Close() error {
+	d.r = nil
 	return nil
 }
 
 func (d *itemDir) meta() *itemMeta {
 	return &d.m
 }
+
+func (d *itemDir) open() (itemFile, error) {
+	return nopCloserFile{bytes.NewReader(d.buf.Bytes())}, nil
+}
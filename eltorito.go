@@ -15,3 +15,16 @@ const (
 	ElToritoFloppy288 ElToritoEmul = 3
 	ElToritoHDD       ElToritoEmul = 4
 )
+
+// floppySize returns the size in bytes of emulated floppies, or 0
+func (e ElToritoEmul) floppySize() int64 {
+	switch e {
+	case ElToritoFloppy122:
+		return 1200 * 1024
+	case ElToritoFloppy144:
+		return 1440 * 1024
+	case ElToritoFloppy288:
+		return 2880 * 1024
+	}
+	return 0
+}
@@ -0,0 +1,585 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatSectorSize     = 512
+	fatReservedSecs   = 1
+	fatCount          = 2
+	fatMinRootEntries = 512
+	fatEntrySize      = 32
+	fatLFNChars       = 13 // characters per long file name entry
+	fatMaxCluster12   = 4084
+	fatMaxCluster16   = 65524
+	fatMaxSecsPerClus = 128
+
+	fatAttrReadOnly  = 0x01
+	fatAttrHidden    = 0x02
+	fatAttrSystem    = 0x04
+	fatAttrVolumeID  = 0x08
+	fatAttrDirectory = 0x10
+	fatAttrArchive   = 0x20
+	fatAttrLFN       = fatAttrReadOnly | fatAttrHidden | fatAttrSystem | fatAttrVolumeID
+)
+
+// ErrFATTooLarge is returned when the files of a FAT image do not fit in a
+// FAT16 filesystem
+var ErrFATTooLarge = errors.New("files do not fit in a FAT16 filesystem")
+
+// FATImage builds a FAT12 or FAT16 filesystem image in memory, such as the
+// EFI system partition image loaded from El Torito entries of the EFI
+// platform. The filesystem is sized automatically to fit its files, FAT12
+// being used for small images.
+//
+// Typical usage
+//
+//	fat := NewFATImage()
+//	err = fat.AddLocalFile("grub/bootx64.efi", "EFI/BOOT/BOOTX64.EFI")
+//	item, err := fat.Item()
+//	err = iw.AddBootEntry(&BootCatalogEntry{Platform: ElToritoEFI}, item, "boot/efiboot.img")
+type FATImage struct {
+	Label    string // Label is the volume label, up to 11 characters
+	VolumeID uint32 // VolumeID is the serial number of the volume
+
+	// ModTime is the modification time of all entries. It defaults to the
+	// SOURCE_DATE_EPOCH environment variable if set, so images are
+	// reproducible, or to the current time. Set it to the SourceDate of the
+	// ImageWriter when using an explicit date.
+	ModTime time.Time
+
+	// Slack is the number of free bytes kept in the filesystem, on top of
+	// the space used by files and directories
+	Slack int64
+
+	root *fatNode
+}
+
+// fatNode is a file or directory of a FAT image
+type fatNode struct {
+	name     string              // original name
+	data     []byte              // file contents
+	children map[string]*fatNode // by upper case name, nil for files
+
+	short    [11]byte // 8.3 name, space padded
+	lfn      bool     // name is stored in long file name entries
+	cluster  uint32   // first cluster, 0 for empty files
+	clusters uint32
+}
+
+// NewFATImage creates a new empty FAT image.
+func NewFATImage() *FATImage {
+	modTime, err := sourceDateEpoch()
+	if err != nil || modTime.IsZero() {
+		// an invalid date fails reproducible images when they are written
+		modTime = time.Now()
+	}
+
+	return &FATImage{
+		ModTime: modTime,
+		root:    &fatNode{children: make(map[string]*fatNode)},
+	}
+}
+
+// AddFile adds a file to the FAT image, creating the directories of
+// filePath as needed. Names are not case sensitive, original names are
+// stored as long file names when needed.
+func (f *FATImage) AddFile(data io.Reader, filePath string) error {
+	segments := splitPath(path.Clean(filePath))
+	if len(segments) == 0 {
+		return os.ErrInvalid
+	}
+
+	pos := f.root
+	for _, name := range segments[:len(segments)-1] {
+		key := strings.ToUpper(name)
+		sub, ok := pos.children[key]
+		if !ok {
+			sub = &fatNode{name: name, children: make(map[string]*fatNode)}
+			pos.children[key] = sub
+		} else if sub.children == nil {
+			return ErrIsDir
+		}
+		pos = sub
+	}
+
+	name := segments[len(segments)-1]
+	key := strings.ToUpper(name)
+	if _, ok := pos.children[key]; ok {
+		// duplicate
+		return os.ErrExist
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, data); err != nil {
+		return err
+	}
+	if int64(buf.Len()) > 0xffffffff {
+		return ErrFileTooLarge
+	}
+	pos.children[key] = &fatNode{name: name, data: buf.Bytes()}
+	return nil
+}
+
+// AddLocalFile adds a file to the FAT image from the local filesystem.
+func (f *FATImage) AddLocalFile(localPath, filePath string) error {
+	fp, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to add local file: %w", err)
+	}
+	defer fp.Close()
+
+	return f.AddFile(fp, filePath)
+}
+
+// Item builds the FAT image and returns it as an Item, to be added to an
+// ImageWriter.
+func (f *FATImage) Item() (Item, error) {
+	data, err := f.build()
+	if err != nil {
+		return nil, err
+	}
+	return &bufferHndlr{d: data}, nil
+}
+
+// sortedChildren returns the children of a directory in name order
+func (n *fatNode) sortedChildren() []*fatNode {
+	keys := make([]string, 0, len(n.children))
+	for k := range n.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]*fatNode, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, n.children[k])
+	}
+	return res
+}
+
+// entries returns the number of directory entries used by the node in its
+// parent directory
+func (n *fatNode) entries() int {
+	if !n.lfn {
+		return 1
+	}
+	return 1 + (len(utf16.Encode([]rune(n.name)))+fatLFNChars-1)/fatLFNChars
+}
+
+// dirEntries returns the number of directory entries of a directory
+func (n *fatNode) dirEntries() int {
+	res := 2 // "." and ".."
+	for _, c := range n.children {
+		res += c.entries()
+	}
+	return res
+}
+
+// fatShortNameChar returns true if c is allowed in 8.3 names
+func fatShortNameChar(c rune) bool {
+	if c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'()-@^_`{}~", c)
+}
+
+// fatShortName returns the 8.3 name of name if it is a valid upper case
+// short name
+func fatShortName(name string) (res [11]byte, ok bool) {
+	base, ext := name, ""
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.ContainsRune(ext, '.') {
+		return res, false
+	}
+	for _, c := range base + ext {
+		if !fatShortNameChar(c) {
+			return res, false
+		}
+	}
+
+	copy(res[:], "           ")
+	copy(res[0:8], base)
+	copy(res[8:11], ext)
+	return res, true
+}
+
+// fatMangledName returns the short name "BASE~N.EXT" derived from name
+func fatMangledName(name string, n int) [11]byte {
+	filter := func(s string) string {
+		var res []byte
+		for _, c := range strings.ToUpper(s) {
+			if c == ' ' || c == '.' {
+				continue
+			}
+			if !fatShortNameChar(c) {
+				c = '_'
+			}
+			res = append(res, byte(c))
+		}
+		return string(res)
+	}
+
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	base, ext = filter(base), filter(ext)
+
+	tail := fmt.Sprintf("~%d", n)
+	if len(base) > 8-len(tail) {
+		base = base[:8-len(tail)]
+	}
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+
+	var res [11]byte
+	copy(res[:], "           ")
+	copy(res[0:8], base+tail)
+	copy(res[8:11], ext)
+	return res
+}
+
+// assignNames sets the 8.3 names of the children of directory n, and of
+// their own children
+func (n *fatNode) assignNames() {
+	used := make(map[[11]byte]bool)
+	children := n.sortedChildren()
+
+	// valid short names come first, so mangled names can't collide with them
+	var mangled []*fatNode
+	for _, c := range children {
+		short, ok := fatShortName(strings.ToUpper(c.name))
+		if ok && !used[short] {
+			c.short, c.lfn = short, c.name != strings.ToUpper(c.name)
+			used[short] = true
+		} else {
+			mangled = append(mangled, c)
+		}
+	}
+	for _, c := range mangled {
+		for i := 1; ; i++ {
+			short := fatMangledName(c.name, i)
+			if !used[short] {
+				c.short, c.lfn = short, true
+				used[short] = true
+				break
+			}
+		}
+	}
+
+	for _, c := range children {
+		if c.children != nil {
+			c.assignNames()
+		}
+	}
+}
+
+// fatLayout is the geometry of a FAT filesystem
+type fatLayout struct {
+	secsPerClus uint32
+	rootEntries uint32
+	fatSecs     uint32
+	clusters    uint32
+	fat16       bool
+}
+
+func (l *fatLayout) clusterSize() uint32 {
+	return l.secsPerClus * fatSectorSize
+}
+
+// dataStart returns the first sector of the data region
+func (l *fatLayout) dataStart() uint32 {
+	return fatReservedSecs + fatCount*l.fatSecs + l.rootEntries*fatEntrySize/fatSectorSize
+}
+
+func (l *fatLayout) totalSecs() uint32 {
+	return l.dataStart() + l.clusters*l.secsPerClus
+}
+
+// clustersOf returns the number of clusters needed for size bytes
+func (l *fatLayout) clustersOf(size int64) uint32 {
+	return uint32((size + int64(l.clusterSize()) - 1) / int64(l.clusterSize()))
+}
+
+// treeClusters returns the number of clusters used by the subdirectories
+// and files of n
+func (l *fatLayout) treeClusters(n *fatNode) uint32 {
+	var res uint32
+	for _, c := range n.children {
+		if c.children != nil {
+			res += l.clustersOf(int64(c.dirEntries()*fatEntrySize)) + l.treeClusters(c)
+		} else {
+			res += l.clustersOf(int64(len(c.data)))
+		}
+	}
+	return res
+}
+
+// layout returns the geometry of the image, using the smallest clusters for
+// which the files fit in a FAT16 filesystem
+func (f *FATImage) layout() (*fatLayout, error) {
+	rootEntries := f.root.dirEntries() - 2
+	if f.Label != "" {
+		rootEntries++
+	}
+	// root directory entries fill whole sectors
+	perSector := fatSectorSize / fatEntrySize
+	rootEntries = (rootEntries + perSector - 1) / perSector * perSector
+	if rootEntries < fatMinRootEntries {
+		rootEntries = fatMinRootEntries
+	}
+	if rootEntries > 0xffff {
+		return nil, ErrFATTooLarge
+	}
+
+	for spc := uint32(1); spc <= fatMaxSecsPerClus; spc *= 2 {
+		l := &fatLayout{secsPerClus: spc, rootEntries: uint32(rootEntries)}
+		clusters := int64(l.treeClusters(f.root))
+		if f.Slack > 0 {
+			clusters += int64(l.clustersOf(f.Slack))
+		}
+		if clusters == 0 {
+			clusters = 1
+		}
+		if clusters > fatMaxCluster16 {
+			continue
+		}
+
+		l.clusters = uint32(clusters)
+		l.fat16 = l.clusters > fatMaxCluster12
+		entries := l.clusters + 2
+		if l.fat16 {
+			l.fatSecs = (entries*2 + fatSectorSize - 1) / fatSectorSize
+		} else {
+			l.fatSecs = ((entries*3+1)/2 + fatSectorSize - 1) / fatSectorSize
+		}
+		return l, nil
+	}
+	return nil, ErrFATTooLarge
+}
+
+// fatTimestamp returns the FAT date and time of t
+func fatTimestamp(t time.Time) (date, tim uint16) {
+	switch {
+	case t.Year() < 1980:
+		return 1<<5 | 1, 0 // 1980-01-01
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tim = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tim
+}
+
+// fatLFNChecksum returns the checksum of a short name, stored in the long
+// file name entries of the same file
+func fatLFNChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// build returns the contents of the FAT image
+func (f *FATImage) build() ([]byte, error) {
+	if len(f.Label) > 11 {
+		return nil, fmt.Errorf("FAT volume label %q is longer than 11 characters", f.Label)
+	}
+	f.root.assignNames()
+
+	l, err := f.layout()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, int64(l.totalSecs())*fatSectorSize)
+
+	// allocate clusters, in tree order
+	next := uint32(2)
+	var alloc func(n *fatNode)
+	alloc = func(n *fatNode) {
+		for _, c := range n.sortedChildren() {
+			size := int64(len(c.data))
+			if c.children != nil {
+				size = int64(c.dirEntries() * fatEntrySize)
+			}
+			c.clusters = l.clustersOf(size)
+			if c.clusters > 0 {
+				c.cluster = next
+				next += c.clusters
+			}
+			if c.children != nil {
+				alloc(c)
+			}
+		}
+	}
+	alloc(f.root)
+
+	f.writeBootSector(data[:fatSectorSize], l)
+
+	// file allocation tables
+	fat := data[fatReservedSecs*fatSectorSize : (fatReservedSecs+l.fatSecs)*fatSectorSize]
+	setCluster := func(n, value uint32) {
+		if l.fat16 {
+			binary.LittleEndian.PutUint16(fat[2*n:], uint16(value))
+			return
+		}
+		pos := n * 3 / 2
+		v := binary.LittleEndian.Uint16(fat[pos:])
+		if n%2 == 0 {
+			v = v&0xf000 | uint16(value&0xfff)
+		} else {
+			v = v&0x000f | uint16(value&0xfff)<<4
+		}
+		binary.LittleEndian.PutUint16(fat[pos:], v)
+	}
+	eoc := uint32(0xffff)
+	setCluster(0, 0xfff8)
+	setCluster(1, eoc)
+
+	clusterData := func(n uint32) []byte {
+		start := int64(l.dataStart()+(n-2)*l.secsPerClus) * fatSectorSize
+		return data[start:]
+	}
+
+	date, tim := fatTimestamp(f.ModTime)
+	var write func(n *fatNode, entries []byte, parent uint32)
+	write = func(n *fatNode, entries []byte, parent uint32) {
+		pos := 0
+		entry := func() []byte {
+			res := entries[pos : pos+fatEntrySize]
+			pos += fatEntrySize
+			return res
+		}
+		record := func(e []byte, short [11]byte, attr byte, cluster uint32, size uint32) {
+			copy(e[0:11], short[:])
+			e[11] = attr
+			binary.LittleEndian.PutUint16(e[14:16], tim)
+			binary.LittleEndian.PutUint16(e[16:18], date)
+			binary.LittleEndian.PutUint16(e[18:20], date)
+			binary.LittleEndian.PutUint16(e[22:24], tim)
+			binary.LittleEndian.PutUint16(e[24:26], date)
+			binary.LittleEndian.PutUint16(e[26:28], uint16(cluster))
+			binary.LittleEndian.PutUint32(e[28:32], size)
+		}
+
+		if n == f.root {
+			if f.Label != "" {
+				var label [11]byte
+				copy(label[:], fmt.Sprintf("%-11s", strings.ToUpper(f.Label)))
+				record(entry(), label, fatAttrVolumeID, 0, 0)
+			}
+		} else {
+			record(entry(), [11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, fatAttrDirectory, n.cluster, 0)
+			record(entry(), [11]byte{'.', '.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, fatAttrDirectory, parent, 0)
+		}
+
+		for _, c := range n.sortedChildren() {
+			if c.lfn {
+				name := utf16.Encode([]rune(c.name))
+				count := (len(name) + fatLFNChars - 1) / fatLFNChars
+				checksum := fatLFNChecksum(c.short)
+				for seq := count; seq > 0; seq-- {
+					e := entry()
+					e[0] = byte(seq)
+					if seq == count {
+						e[0] |= 0x40 // last entry
+					}
+					e[11] = fatAttrLFN
+					e[13] = checksum
+					for i := 0; i < fatLFNChars; i++ {
+						ch := uint16(0xffff)
+						switch idx := (seq-1)*fatLFNChars + i; {
+						case idx < len(name):
+							ch = name[idx]
+						case idx == len(name):
+							ch = 0
+						}
+						offset := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}[i]
+						binary.LittleEndian.PutUint16(e[offset:], ch)
+					}
+				}
+			}
+
+			if c.children != nil {
+				record(entry(), c.short, fatAttrDirectory, c.cluster, 0)
+				parentCluster := n.cluster
+				if n == f.root {
+					parentCluster = 0
+				}
+				write(c, clusterData(c.cluster), parentCluster)
+			} else {
+				record(entry(), c.short, fatAttrArchive, c.cluster, uint32(len(c.data)))
+				if c.clusters > 0 {
+					copy(clusterData(c.cluster), c.data)
+				}
+			}
+
+			// contiguous cluster chain
+			for i := uint32(0); i < c.clusters; i++ {
+				if i == c.clusters-1 {
+					setCluster(c.cluster+i, eoc)
+				} else {
+					setCluster(c.cluster+i, c.cluster+i+1)
+				}
+			}
+		}
+	}
+	rootStart := int64(fatReservedSecs+fatCount*l.fatSecs) * fatSectorSize
+	write(f.root, data[rootStart:rootStart+int64(l.rootEntries)*fatEntrySize], 0)
+
+	// second copy of the FAT
+	copy(data[(fatReservedSecs+l.fatSecs)*fatSectorSize:], fat)
+
+	return data, nil
+}
+
+// writeBootSector writes the boot sector and BIOS parameter block of the
+// filesystem
+func (f *FATImage) writeBootSector(data []byte, l *fatLayout) {
+	copy(data[0:3], []byte{0xeb, 0x3c, 0x90}) // jump over the BPB
+	copy(data[3:11], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(data[11:13], fatSectorSize)
+	data[13] = byte(l.secsPerClus)
+	binary.LittleEndian.PutUint16(data[14:16], fatReservedSecs)
+	data[16] = fatCount
+	binary.LittleEndian.PutUint16(data[17:19], uint16(l.rootEntries))
+	if total := l.totalSecs(); total <= 0xffff {
+		binary.LittleEndian.PutUint16(data[19:21], uint16(total))
+	} else {
+		binary.LittleEndian.PutUint32(data[32:36], total)
+	}
+	data[21] = 0xf8 // fixed media
+	binary.LittleEndian.PutUint16(data[22:24], uint16(l.fatSecs))
+	binary.LittleEndian.PutUint16(data[24:26], 32) // sectors per track
+	binary.LittleEndian.PutUint16(data[26:28], 64) // heads
+	data[36] = 0x80                                // drive number
+	data[38] = 0x29                                // extended boot signature
+	binary.LittleEndian.PutUint32(data[39:43], f.VolumeID)
+
+	label := "NO NAME"
+	if f.Label != "" {
+		label = strings.ToUpper(f.Label)
+	}
+	copy(data[43:54], fmt.Sprintf("%-11s", label))
+	if l.fat16 {
+		copy(data[54:62], "FAT16   ")
+	} else {
+		copy(data[54:62], "FAT12   ")
+	}
+	data[510], data[511] = 0x55, 0xaa
+}
@@ -0,0 +1,212 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fatReader reads the files of a FAT image, to check the images built by
+// FATImage
+type fatReader struct {
+	data        []byte
+	secsPerClus uint32
+	fatStart    uint32
+	rootStart   uint32
+	rootEntries uint32
+	dataStart   uint32
+	fat16       bool
+}
+
+func newFATReader(t *testing.T, data []byte) *fatReader {
+	assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+	r := &fatReader{
+		data:        data,
+		secsPerClus: uint32(data[13]),
+		fatStart:    uint32(binary.LittleEndian.Uint16(data[14:16])),
+		rootEntries: uint32(binary.LittleEndian.Uint16(data[17:19])),
+	}
+	fatSecs := uint32(binary.LittleEndian.Uint16(data[22:24]))
+	total := uint32(binary.LittleEndian.Uint16(data[19:21]))
+	if total == 0 {
+		total = binary.LittleEndian.Uint32(data[32:36])
+	}
+	assert.Equal(t, len(data), int(total)*512)
+
+	r.rootStart = r.fatStart + uint32(data[16])*fatSecs
+	r.dataStart = r.rootStart + r.rootEntries*32/512
+	// the FAT type is only determined by the number of clusters
+	r.fat16 = (total-r.dataStart)/r.secsPerClus > fatMaxCluster12
+	if r.fat16 {
+		assert.Equal(t, "FAT16   ", string(data[54:62]))
+	} else {
+		assert.Equal(t, "FAT12   ", string(data[54:62]))
+	}
+
+	// both FAT copies are identical
+	fatLen := fatSecs * 512
+	assert.Equal(t, data[r.fatStart*512:r.fatStart*512+fatLen], data[r.fatStart*512+fatLen:r.fatStart*512+2*fatLen])
+	return r
+}
+
+func (r *fatReader) next(cluster uint32) uint32 {
+	fat := r.data[r.fatStart*512:]
+	if r.fat16 {
+		return uint32(binary.LittleEndian.Uint16(fat[2*cluster:]))
+	}
+	v := uint32(binary.LittleEndian.Uint16(fat[cluster*3/2:]))
+	if cluster%2 == 0 {
+		return v & 0xfff
+	}
+	return v >> 4
+}
+
+// chain returns the data of the cluster chain starting at cluster
+func (r *fatReader) chain(cluster uint32) []byte {
+	var res []byte
+	size := r.secsPerClus * 512
+	for cluster >= 2 && cluster < 0xff8 || r.fat16 && cluster >= 2 && cluster < 0xfff8 {
+		start := (r.dataStart + (cluster-2)*r.secsPerClus) * 512
+		res = append(res, r.data[start:start+size]...)
+		cluster = r.next(cluster)
+	}
+	return res
+}
+
+// list returns the entries of a directory by name, long names taking
+// precedence over short names
+func (r *fatReader) list(entries []byte) map[string][]byte {
+	res := make(map[string][]byte)
+	var lfn []uint16
+	for pos := 0; pos+32 <= len(entries); pos += 32 {
+		e := entries[pos : pos+32]
+		switch {
+		case e[0] == 0:
+			return res
+		case e[11] == fatAttrLFN:
+			var chars []uint16
+			for _, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				chars = append(chars, binary.LittleEndian.Uint16(e[offset:]))
+			}
+			lfn = append(chars, lfn...)
+			continue
+		case e[11]&fatAttrVolumeID != 0:
+			continue
+		}
+
+		name := strings.TrimRight(string(e[0:8]), " ")
+		if ext := strings.TrimRight(string(e[8:11]), " "); ext != "" {
+			name += "." + ext
+		}
+		if lfn != nil {
+			for i, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:i]
+					break
+				}
+			}
+			name = string(utf16.Decode(lfn))
+			lfn = nil
+		}
+		res[name] = e
+	}
+	return res
+}
+
+// readFile returns the contents of the file at the given path
+func (r *fatReader) readFile(t *testing.T, name string) []byte {
+	start := r.rootStart * 512
+	dir := r.data[start : start+r.rootEntries*32]
+	segments := strings.Split(name, "/")
+	for n, seg := range segments {
+		e, ok := r.list(dir)[seg]
+		if !assert.True(t, ok, name) {
+			return nil
+		}
+		cluster := uint32(binary.LittleEndian.Uint16(e[26:28]))
+		if n < len(segments)-1 {
+			assert.Equal(t, byte(fatAttrDirectory), e[11])
+			dir = r.chain(cluster)
+			continue
+		}
+		size := binary.LittleEndian.Uint32(e[28:32])
+		return r.chain(cluster)[:size]
+	}
+	return nil
+}
+
+func TestFATImage(t *testing.T) {
+	loader := bytes.Repeat([]byte("BOOTX64"), 1000)
+	large := bytes.Repeat([]byte{0xa5}, 3<<20)
+
+	for _, testcase := range []struct {
+		files map[string][]byte
+		fat16 bool
+	}{
+		{map[string][]byte{
+			"EFI/BOOT/BOOTX64.EFI":    loader,
+			"EFI/BOOT/grub.cfg":       []byte("set timeout=5\n"),
+			"EFI/BOOT/GRUB.cfg.bak":   []byte("backup"),
+			"boot/Long File Name.txt": []byte("long"),
+			"empty":                   nil,
+		}, false},
+		{map[string][]byte{"EFI/BOOT/BOOTX64.EFI": loader, "big.bin": large}, true},
+	} {
+		fat := NewFATImage()
+		fat.Label = "efiboot"
+		fat.ModTime = time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+		for name, data := range testcase.files {
+			assert.NoError(t, fat.AddFile(bytes.NewReader(data), name))
+		}
+
+		item, err := fat.Item()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		data, err := ioutil.ReadAll(item)
+		assert.NoError(t, err)
+
+		r := newFATReader(t, data)
+		assert.Equal(t, testcase.fat16, r.fat16)
+		assert.Equal(t, "EFIBOOT    ", string(data[43:54]))
+		for name, content := range testcase.files {
+			assert.Equal(t, len(content), len(r.readFile(t, name)), name)
+			assert.True(t, bytes.Equal(content, r.readFile(t, name)), name)
+		}
+
+		// short names are valid 8.3 names
+		root := r.list(r.data[r.rootStart*512 : r.dataStart*512])
+		efi := r.list(r.chain(uint32(binary.LittleEndian.Uint16(root["EFI"][26:28]))))
+		assert.Equal(t, ".          ", string(efi["."][0:11]))
+		for name, e := range efi {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			_, ok := fatShortName(strings.TrimRight(string(e[0:8]), " ") + "." + strings.TrimRight(string(e[8:11]), " "))
+			assert.True(t, ok, string(e[0:11]))
+		}
+	}
+
+	// slack space is added to the image
+	sizes := []int64{}
+	for _, slack := range []int64{0, 1 << 20} {
+		fat := NewFATImage()
+		fat.Slack = slack
+		assert.NoError(t, fat.AddFile(bytes.NewReader(loader), "EFI/BOOT/BOOTX64.EFI"))
+		item, err := fat.Item()
+		assert.NoError(t, err)
+		sizes = append(sizes, item.Size())
+	}
+	assert.True(t, sizes[1]-sizes[0] >= 1<<20)
+
+	fat := NewFATImage()
+	assert.NoError(t, fat.AddFile(bytes.NewReader(loader), "EFI/BOOT/BOOTX64.EFI"))
+	assert.Equal(t, ErrIsDir, fat.AddFile(bytes.NewReader(loader), "EFI/BOOT/BOOTX64.EFI/file"))
+	assert.Error(t, fat.AddFile(bytes.NewReader(loader), "efi/boot/bootx64.efi"))
+}
@@ -0,0 +1,378 @@
+package iso9660
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	_ fs.FS         = &Image{}
+	_ fs.ReadDirFS  = &Image{}
+	_ fs.StatFS     = &Image{}
+	_ fs.ReadFileFS = &Image{}
+)
+
+// Open opens the named file or directory of the image, as seen from RootDir.
+// It implements fs.FS so that an Image can be used with fs.WalkDir, http.FS,
+// template.ParseFS, etc.
+//
+// Names are matched exactly first, then ignoring the version suffix (";1")
+// and empty extension of ISO9660 identifiers, and without case for entries
+// that have no Rock Ridge or Joliet name.
+func (i *Image) Open(name string) (fs.File, error) {
+	f, err := i.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &openFile{f: f, name: name}
+	if !f.IsDir() {
+		res.r = f.sectionReader()
+	}
+	return res, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name
+func (i *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := i.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return readDirEntries(f, name)
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory
+func (i *Image) Stat(name string) (fs.FileInfo, error) {
+	f, err := i.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo(f, name), nil
+}
+
+// ReadFile reads the named file and returns its contents
+func (i *Image) ReadFile(name string) ([]byte, error) {
+	f, err := i.resolve("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if f.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: ErrIsDir}
+	}
+
+	data := make([]byte, f.Size())
+	if _, err = io.ReadFull(f.sectionReader(), data); err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// resolve returns the File found at name, which must be a valid fs.FS path
+func (i *Image) resolve(op, name string) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	var segments []string
+	if name != "." {
+		segments = strings.Split(name, "/")
+	}
+
+	f, err := i.lookup(segments)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// Lookup returns the file or directory found at the given slash-separated
+// path, as seen from RootDir. Leading slashes are ignored, and names are
+// matched as with Open.
+//
+// Directories are located with the path tables of the volume, so that only
+// the extent of the directory holding the file is read. The directory tree is
+// walked instead if the path tables are missing, inconsistent or don't list a
+// directory: path tables only hold ISO9660 identifiers, which on Rock Ridge
+// volumes are only used when they are equal to the requested name.
+func (i *Image) Lookup(name string) (*File, error) {
+	f, err := i.lookup(splitPath(path.Clean("/" + name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "lookup", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// lookup returns the File found at the given path segments
+func (i *Image) lookup(segments []string) (*File, error) {
+	root, err := i.RootDir()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return root, nil
+	}
+
+	parent := segments[:len(segments)-1]
+	dir := root
+	if len(parent) > 0 {
+		if dir, err = i.lookupDir(root, parent); err != nil {
+			// walk the tree instead
+			dir = root
+			for _, seg := range parent {
+				if dir, err = dir.lookupChild(seg); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return dir.lookupChild(segments[len(segments)-1])
+}
+
+// lookupDir returns the directory found at the given path segments, located
+// using the path tables of the volume of root
+func (i *Image) lookupDir(root *File, segments []string) (*File, error) {
+	i.pathTableOnce.Do(func() {
+		vd := i.jolietVolume()
+		if vd == nil {
+			vd = i.primaryVolume()
+		}
+		// unusable path tables only mean the tree will be walked
+		i.pathTable, _ = readPathTables(i.ra, vd)
+	})
+	table := i.pathTable
+	if table == nil {
+		return nil, errInconsistentPathTable
+	}
+
+	rockRidge := root.susp != nil && root.susp.rockRidge
+	number := 1 // directory numbers start at 1 with the root
+	for _, seg := range segments {
+		found := 0
+		// directories are listed after their parent
+		for n := number; n < len(table); n++ {
+			if int(table[n].ParentNumber) == number && root.matchPathTableName(table[n].Identifier, seg) {
+				if found != 0 {
+					// Rock Ridge names matching several identifiers
+					return nil, errInconsistentPathTable
+				}
+				found = n + 1
+				if !rockRidge {
+					break
+				}
+			}
+		}
+		if found == 0 {
+			return nil, fs.ErrNotExist
+		}
+		number = found
+	}
+
+	dir, err := i.pathTableDir(root, table, number)
+	if err != nil {
+		return nil, err
+	}
+
+	if rockRidge {
+		// Rock Ridge names are matched loosely, check the real name of the
+		// final directory in its parent
+		parent, err := i.pathTableDir(root, table, int(table[number-1].ParentNumber))
+		if err != nil {
+			return nil, err
+		}
+		c, err := parent.lookupChild(segments[len(segments)-1])
+		if err != nil || c.de.ExtentLocation != dir.de.ExtentLocation {
+			return nil, errInconsistentPathTable
+		}
+	}
+	return dir, nil
+}
+
+// pathTableDir returns the directory of the given number in a path table of
+// the volume of root
+func (i *Image) pathTableDir(root *File, table []pathTableRecord, number int) (*File, error) {
+	loc := int32(table[number-1].ExtentLocation)
+	self, err := readDirSelf(i.ra, loc)
+	if err != nil {
+		return nil, err
+	}
+	if self.Identifier != string([]byte{0}) || self.ExtentLocation != loc || self.FileFlags&dirFlagDir == 0 {
+		return nil, errInconsistentPathTable
+	}
+	return &File{ra: i.ra, de: self, joliet: root.joliet, susp: root.susp}, nil
+}
+
+// pathTableMangler mangles Rock Ridge names to look them up in path tables
+var pathTableMangler, _ = newMangler(0, Relaxations{})
+
+// matchPathTableName returns true if the path table identifier of a directory
+// of the same volume as f designates name
+func (f *File) matchPathTableName(identifier, name string) bool {
+	switch {
+	case f.joliet:
+		return decodeUCS2([]byte(identifier)) == name
+	case f.susp != nil && f.susp.rockRidge:
+		// the identifier is usually the name mangled by the writer, such as
+		// "MY_DIR" for "My.Dir"
+		return strings.EqualFold(identifier, name) || identifier == pathTableMangler.dirName(name, "")
+	default:
+		return strings.EqualFold(identifier, name)
+	}
+}
+
+// lookupChild returns the child of directory f matching name
+func (f *File) lookupChild(name string) (*File, error) {
+	if !f.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	children, err := f.GetChildren()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range children {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	for _, c := range children {
+		if c.matchName(name) {
+			return c, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// matchName returns true if name loosely designates the entry: with or
+// without version suffix and empty extension, and without case for plain
+// ISO9660 names
+func (f *File) matchName(name string) bool {
+	if f.de.Identifier == name {
+		return true
+	}
+
+	if pos := strings.LastIndexByte(name, ';'); pos != -1 {
+		name = name[:pos]
+	}
+	name = strings.TrimSuffix(name, ".")
+
+	own := f.Name()
+	if own == name {
+		return true
+	}
+	if (f.rr == nil || f.rr.Name == "") && !f.joliet {
+		return strings.EqualFold(own, name)
+	}
+	return false
+}
+
+// readDirEntries returns the entries of directory f sorted by name
+func readDirEntries(f *File, name string) ([]fs.DirEntry, error) {
+	if !f.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	children, err := f.GetChildren()
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	res := make([]fs.DirEntry, len(children))
+	for n, c := range children {
+		res[n] = fs.FileInfoToDirEntry(c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+// fsFileInfo returns the fs.FileInfo of f, opened under the given path
+func fsFileInfo(f *File, name string) fs.FileInfo {
+	if name == "." {
+		// the root directory has a special identifier
+		return &rootFileInfo{f}
+	}
+	return f
+}
+
+type rootFileInfo struct {
+	*File
+}
+
+func (r *rootFileInfo) Name() string {
+	return "."
+}
+
+// openFile is a file or directory opened through Image.Open
+type openFile struct {
+	f       *File
+	name    string
+	r       *io.SectionReader // file data, nil for directories
+	entries []fs.DirEntry     // remaining directory entries for ReadDir
+	listed  bool
+}
+
+var (
+	_ fs.ReadDirFile = &openFile{}
+	_ io.ReadSeeker  = &openFile{}
+	_ io.ReaderAt    = &openFile{}
+)
+
+func (o *openFile) Stat() (fs.FileInfo, error) {
+	return fsFileInfo(o.f, o.name), nil
+}
+
+func (o *openFile) Read(p []byte) (int, error) {
+	if o.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: o.name, Err: ErrIsDir}
+	}
+	return o.r.Read(p)
+}
+
+func (o *openFile) ReadAt(p []byte, off int64) (int, error) {
+	if o.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: o.name, Err: ErrIsDir}
+	}
+	return o.r.ReadAt(p, off)
+}
+
+func (o *openFile) Seek(offset int64, whence int) (int64, error) {
+	if o.r == nil {
+		return 0, &fs.PathError{Op: "seek", Path: o.name, Err: ErrIsDir}
+	}
+	return o.r.Seek(offset, whence)
+}
+
+// ReadDir returns the next n entries of a directory, as per fs.ReadDirFile
+func (o *openFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !o.listed {
+		entries, err := readDirEntries(o.f, o.name)
+		if err != nil {
+			return nil, err
+		}
+		o.entries = entries
+		o.listed = true
+	}
+
+	if n <= 0 {
+		res := o.entries
+		o.entries = nil
+		return res, nil
+	}
+	if len(o.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(o.entries) {
+		n = len(o.entries)
+	}
+	res := o.entries[:n]
+	o.entries = o.entries[n:]
+	return res, nil
+}
+
+func (o *openFile) Close() error {
+	return nil
+}
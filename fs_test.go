@@ -0,0 +1,71 @@
+package iso9660
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageFS(t *testing.T) {
+	f, err := os.Open("fixtures/test.iso")
+	assert.NoError(t, err)
+	defer f.Close() // nolint: errcheck
+
+	image, err := OpenImage(f)
+	assert.NoError(t, err)
+
+	assert.NoError(t, fstest.TestFS(image, "CICERO.TXT", "DIR1/LOREM_IP.TXT", "DIR2/DIR3/DATA.BIN", "DIR4/FILE1012"))
+
+	// version suffixes, optional extensions and case
+	for _, name := range []string{"CICERO.TXT;1", "cicero.txt", "dir2/large.txt;1", "DIR4/FILE1012.", "DIR4/FILE1012.;1"} {
+		_, err := image.Stat(name)
+		assert.NoError(t, err, name)
+	}
+
+	data, err := image.ReadFile("dir1/lorem_ip.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, loremIpsum, string(data))
+
+	var count int
+	err = fs.WalkDir(image, ".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1004, count)
+
+	_, err = image.Open("missing.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = image.Open("/CICERO.TXT")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+}
+
+func TestImageFSExtensions(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	w.Joliet = true
+
+	assert.NoError(t, w.AddFile(strings.NewReader("index"), "www/Index.html"))
+	assert.NoError(t, w.AddFile(strings.NewReader("body {}"), "www/css/Style Sheet.css"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	for _, opt := range []ImageOption{IgnoreJoliet(), IgnoreRockRidge()} {
+		image, err := OpenImage(bytes.NewReader(buf.Bytes()), opt)
+		assert.NoError(t, err)
+		assert.NoError(t, fstest.TestFS(image, "www/Index.html", "www/css/Style Sheet.css"))
+
+		// long names are case sensitive
+		_, err = image.Stat("www/index.html")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -12,16 +13,57 @@ import (
 type Image struct {
 	ra                io.ReaderAt
 	volumeDescriptors []volumeDescriptor
+	ignoreJoliet      bool
+	ignoreRockRidge   bool
+	susp              *suspContext // SUSP parameters of the primary volume, if any
+
+	pathTableOnce sync.Once
+	pathTable     []pathTableRecord // path table of the RootDir volume, nil if unusable
+}
+
+// ImageOption is an option that can be passed to OpenImage to alter how the
+// image is read
+type ImageOption func(*Image)
+
+// IgnoreJoliet makes RootDir return the primary volume tree even if a Joliet
+// supplementary volume is available.
+func IgnoreJoliet() ImageOption {
+	return func(i *Image) {
+		i.ignoreJoliet = true
+	}
+}
+
+// IgnoreRockRidge disables parsing of Rock Ridge extensions, so that entries
+// are only described by their ISO9660 records.
+func IgnoreRockRidge() ImageOption {
+	return func(i *Image) {
+		i.ignoreRockRidge = true
+	}
 }
 
 // OpenImage returns an Image reader reating from a given file
-func OpenImage(ra io.ReaderAt) (*Image, error) {
+func OpenImage(ra io.ReaderAt, opts ...ImageOption) (*Image, error) {
 	i := &Image{ra: ra}
 
+	for _, opt := range opts {
+		opt(i)
+	}
+
 	if err := i.readVolumes(); err != nil {
 		return nil, err
 	}
 
+	if !i.ignoreRockRidge {
+		for _, vd := range i.volumeDescriptors {
+			if vd.Type() == volumeTypePrimary {
+				// an unreadable root will be reported when accessed, this
+				// only means the image will be read without extensions
+				i.susp, _ = detectSUSP(i.ra, vd.Primary.RootDirectoryEntry)
+				break
+			}
+		}
+	}
+
 	return i, nil
 }
 
@@ -56,15 +98,76 @@ func (i *Image) Label() (string, error) {
 	return "", fmt.Errorf("no primary volumes found")
 }
 
-// RootDir returns the File structure corresponding to the root directory
-// of the first primary volume
+// HasJoliet returns true if the image contains a Joliet supplementary volume
+func (i *Image) HasJoliet() bool {
+	for _, vd := range i.volumeDescriptors {
+		if vd.isJoliet() {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRockRidge returns true if the primary volume uses Rock Ridge extensions
+func (i *Image) HasRockRidge() bool {
+	return i.susp != nil && i.susp.rockRidge
+}
+
+// RootDir returns the File structure corresponding to the root directory of
+// the image. The primary volume is used if it has Rock Ridge extensions, else
+// the first Joliet volume if any, else the plain primary volume. Extensions
+// can be disabled with IgnoreRockRidge and IgnoreJoliet.
 func (i *Image) RootDir() (*File, error) {
+	if vd := i.jolietVolume(); vd != nil {
+		return &File{de: vd.RootDirectoryEntry, ra: i.ra, children: nil, joliet: true}, nil
+	}
+	return i.PrimaryRootDir()
+}
+
+// PrimaryRootDir returns the File structure corresponding to the root
+// directory of the first primary volume, ignoring any supplementary volume
+func (i *Image) PrimaryRootDir() (*File, error) {
+	vd := i.primaryVolume()
+	if vd == nil {
+		return nil, fmt.Errorf("no primary volumes found")
+	}
+
+	f := &File{de: vd.RootDirectoryEntry, ra: i.ra, children: nil, susp: i.susp}
+	if i.HasRockRidge() {
+		// the root's attributes are stored in its own "." record
+		self, err := readDirSelf(i.ra, f.de.ExtentLocation)
+		if err != nil {
+			return nil, err
+		}
+		if err = f.loadRockRidge(self); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// primaryVolume returns the first primary volume descriptor, or nil
+func (i *Image) primaryVolume() *PrimaryVolumeDescriptorBody {
 	for _, vd := range i.volumeDescriptors {
 		if vd.Type() == volumeTypePrimary {
-			return &File{de: vd.Primary.RootDirectoryEntry, ra: i.ra, children: nil}, nil
+			return vd.Primary
 		}
 	}
-	return nil, fmt.Errorf("no primary volumes found")
+	return nil
+}
+
+// jolietVolume returns the Joliet volume descriptor used by RootDir, or nil if
+// RootDir uses the primary volume
+func (i *Image) jolietVolume() *PrimaryVolumeDescriptorBody {
+	if i.ignoreJoliet || i.HasRockRidge() {
+		return nil
+	}
+	for _, vd := range i.volumeDescriptors {
+		if vd.isJoliet() {
+			return vd.Primary
+		}
+	}
+	return nil
 }
 
 // File is a os.FileInfo-compatible wrapper around an ISO9660 directory entry
@@ -72,22 +175,60 @@ type File struct {
 	ra       io.ReaderAt
 	de       *DirectoryEntry
 	children []*File
+	sections []*DirectoryEntry // records of a multi-extent file, nil otherwise
+	joliet   bool              // entry is part of a Joliet hierarchy
+	susp     *suspContext      // SUSP parameters of the volume, if any
+	rr       *RockRidgeInfo    // Rock Ridge attributes, if any
 }
 
 var _ os.FileInfo = &File{}
 
+// readDirSelf reads the "." record of the directory at the given location
+func readDirSelf(ra io.ReaderAt, location int32) (*DirectoryEntry, error) {
+	buffer := make([]byte, sectorSize)
+	if _, err := ra.ReadAt(buffer, int64(location)*int64(sectorSize)); err != nil {
+		return nil, err
+	}
+
+	self := &DirectoryEntry{}
+	if err := self.UnmarshalBinary(buffer); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// loadRockRidge parses the Rock Ridge entries found in the system use area of
+// de and attaches them to the file
+func (f *File) loadRockRidge(de *DirectoryEntry) error {
+	entries, err := f.susp.readSystemUse(f.ra, de)
+	if err != nil {
+		return err
+	}
+	f.rr, err = parseRockRidge(entries)
+	return err
+}
+
 // IsDir returns true if the entry is a directory or false otherwise
 func (f *File) IsDir() bool {
 	return f.de.FileFlags&dirFlagDir != 0
 }
 
-// ModTime returns the entry's recording time
+// ModTime returns the entry's modification time if recorded by Rock Ridge, or
+// its recording time
 func (f *File) ModTime() time.Time {
+	if f.rr != nil && !f.rr.ModificationTime.IsZero() {
+		return f.rr.ModificationTime
+	}
 	return time.Time(f.de.RecordingDateTime)
 }
 
-// Mode returns os.FileMode flag set with the os.ModeDir flag enabled in case of directories
+// Mode returns the entry's POSIX mode if recorded by Rock Ridge, or else an
+// os.FileMode flag set with the os.ModeDir flag enabled in case of directories
 func (f *File) Mode() os.FileMode {
+	if f.rr != nil && f.rr.Mode != 0 {
+		return f.rr.FileMode()
+	}
+
 	var mode os.FileMode
 	if f.IsDir() {
 		mode |= os.ModeDir
@@ -97,6 +238,14 @@ func (f *File) Mode() os.FileMode {
 
 // Name returns the base name of the given entry
 func (f *File) Name() string {
+	if f.rr != nil && f.rr.Name != "" {
+		return f.rr.Name
+	}
+
+	if f.joliet {
+		return f.jolietName()
+	}
+
 	if f.IsDir() {
 		return f.de.Identifier
 	}
@@ -110,7 +259,7 @@ func (f *File) Name() string {
 	splitFileIdentifier := strings.Split(fileIdentifier, ".")
 
 	// extension is empty, return just the name without a dot
-	if len(splitFileIdentifier[1]) == 0 {
+	if len(splitFileIdentifier) == 1 || len(splitFileIdentifier[1]) == 0 {
 		return splitFileIdentifier[0]
 	}
 
@@ -118,14 +267,45 @@ func (f *File) Name() string {
 	return fileIdentifier
 }
 
-// Size returns the size in bytes of the extent occupied by the file or directory
+// jolietName returns the name of a Joliet entry, decoded from UCS-2 and with
+// its version part removed
+func (f *File) jolietName() string {
+	if len(f.de.Identifier) == 1 {
+		// special entries such as the root directory's 0x00
+		return f.de.Identifier
+	}
+
+	name := decodeUCS2([]byte(f.de.Identifier))
+	if f.IsDir() {
+		return name
+	}
+
+	if pos := strings.LastIndexByte(name, ';'); pos != -1 {
+		name = name[:pos]
+	}
+	return name
+}
+
+// Size returns the size in bytes of the extents occupied by the file or
+// directory
 func (f *File) Size() int64 {
-	return int64(f.de.ExtentLength)
+	if f.sections == nil {
+		return int64(uint32(f.de.ExtentLength))
+	}
+
+	var size int64
+	for _, de := range f.sections {
+		size += int64(uint32(de.ExtentLength))
+	}
+	return size
 }
 
-// Sys returns nil
+// Sys returns a *RockRidgeInfo on Rock Ridge volumes, or nil
 func (f *File) Sys() interface{} {
-	return nil
+	if f.rr == nil {
+		return nil
+	}
+	return f.rr
 }
 
 // GetChildren returns the chilren entries in case of a directory
@@ -139,11 +319,11 @@ func (f *File) GetChildren() ([]*File, error) {
 		return f.children, nil
 	}
 
-	baseOffset := uint32(f.de.ExtentLocation) * sectorSize
+	baseOffset := dataOffset(f.de)
 
 	buffer := make([]byte, sectorSize)
-	for bytesProcessed := uint32(0); bytesProcessed < uint32(f.de.ExtentLength); bytesProcessed += sectorSize {
-		if _, err := f.ra.ReadAt(buffer, int64(baseOffset+bytesProcessed)); err != nil {
+	for bytesProcessed := int64(0); bytesProcessed < int64(uint32(f.de.ExtentLength)); bytesProcessed += int64(sectorSize) {
+		if _, err := f.ra.ReadAt(buffer, baseOffset+bytesProcessed); err != nil {
 			return nil, nil
 		}
 
@@ -166,9 +346,32 @@ func (f *File) GetChildren() ([]*File, error) {
 				continue
 			}
 
+			if last := len(f.children) - 1; last >= 0 && f.children[last].continuedBy(newDE) {
+				// next section of a multi-extent file
+				f.children[last].addSection(newDE)
+				continue
+			}
+
 			newFile := &File{ra: f.ra,
 				de:       newDE,
 				children: nil,
+				joliet:   f.joliet,
+				susp:     f.susp,
+			}
+
+			if f.susp != nil && f.susp.rockRidge {
+				if err := newFile.loadRockRidge(newDE); err != nil {
+					return nil, err
+				}
+				if newFile.rr.Relocated {
+					// listed in its original location through a CL entry
+					continue
+				}
+				if newFile.rr.ChildLink != 0 {
+					if err := newFile.followChildLink(); err != nil {
+						return nil, err
+					}
+				}
 			}
 
 			f.children = append(f.children, newFile)
@@ -178,6 +381,43 @@ func (f *File) GetChildren() ([]*File, error) {
 	return f.children, nil
 }
 
+// continuedBy returns true if de is the next section of multi-extent file f
+func (f *File) continuedBy(de *DirectoryEntry) bool {
+	last := f.de
+	if f.sections != nil {
+		last = f.sections[len(f.sections)-1]
+	}
+	return last.FileFlags&dirFlagMultiExtent != 0 && last.Identifier == de.Identifier
+}
+
+// addSection adds de to the sections of multi-extent file f
+func (f *File) addSection(de *DirectoryEntry) {
+	if f.sections == nil {
+		f.sections = []*DirectoryEntry{f.de}
+	}
+	f.sections = append(f.sections, de)
+}
+
+// followChildLink replaces the placeholder entry of a relocated directory
+// with the directory found at the location of its CL entry
+func (f *File) followChildLink() error {
+	self, err := readDirSelf(f.ra, f.rr.ChildLink)
+	if err != nil {
+		return err
+	}
+	self.Identifier = f.de.Identifier
+	name := f.rr.Name
+
+	f.de = self
+	if err = f.loadRockRidge(self); err != nil {
+		return err
+	}
+	if f.rr.Name == "" || f.rr.Name == "." {
+		f.rr.Name = name
+	}
+	return nil
+}
+
 // Reader returns a reader that allows to read the file's data.
 // If File is a directory, it returns nil.
 func (f *File) Reader() io.Reader {
@@ -185,6 +425,72 @@ func (f *File) Reader() io.Reader {
 		return nil
 	}
 
-	baseOffset := int64(f.de.ExtentLocation) * int64(sectorSize)
-	return io.NewSectionReader(f.ra, baseOffset, int64(f.de.ExtentLength))
+	return f.sectionReader()
+}
+
+// sectionReader returns a reader over the file's data, spanning all the
+// sections of multi-extent files
+func (f *File) sectionReader() *io.SectionReader {
+	if f.sections != nil {
+		return io.NewSectionReader(&sectionsReader{ra: f.ra, sections: f.sections}, 0, f.Size())
+	}
+
+	return io.NewSectionReader(f.ra, dataOffset(f.de), int64(uint32(f.de.ExtentLength)))
+}
+
+// dataOffset returns the offset of the data of an extent, which follows its
+// extended attribute record if any
+func dataOffset(de *DirectoryEntry) int64 {
+	return (int64(uint32(de.ExtentLocation)) + int64(de.ExtendedAtributeRecordLength)) * int64(sectorSize)
+}
+
+// ExtendedAttributes returns the Extended Attribute Record of the file, or
+// nil if it has none
+func (f *File) ExtendedAttributes() (*ExtendedAttributeRecord, error) {
+	if f.de.ExtendedAtributeRecordLength == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, int(f.de.ExtendedAtributeRecordLength)*int(sectorSize))
+	if _, err := f.ra.ReadAt(data, int64(uint32(f.de.ExtentLocation))*int64(sectorSize)); err != nil {
+		return nil, err
+	}
+	ear := &ExtendedAttributeRecord{}
+	if err := ear.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return ear, nil
+}
+
+// sectionsReader reads the extents of a multi-extent file as if they were
+// contiguous
+type sectionsReader struct {
+	ra       io.ReaderAt
+	sections []*DirectoryEntry
+}
+
+func (r *sectionsReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, de := range r.sections {
+		length := int64(uint32(de.ExtentLength))
+		if off >= length {
+			off -= length
+			continue
+		}
+
+		buf := p[n:]
+		if int64(len(buf)) > length-off {
+			buf = buf[:length-off]
+		}
+		m, err := r.ra.ReadAt(buf, dataOffset(de)+off)
+		n += m
+		if err != nil && !(err == io.EOF && m == len(buf)) {
+			return n, err
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		off = 0
+	}
+	return n, io.EOF
 }
@@ -1,6 +1,7 @@
 package iso9660
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -87,3 +88,94 @@ func TestImageReader(t *testing.T) {
 		assert.Equal(t, "FILE1012", dir4Children[12].Name())
 	}
 }
+
+// buildJolietTestImage builds a minimal image with a primary volume and a
+// Joliet supplementary volume sharing the same file data
+func buildJolietTestImage(t *testing.T) []byte {
+	img := make([]byte, 24*sectorSize)
+	fileData := []byte("hello joliet")
+
+	dirDE := func(id string, sector int32) DirectoryEntry {
+		return DirectoryEntry{ExtentLocation: sector, ExtentLength: int32(sectorSize), FileFlags: dirFlagDir, VolumeSequenceNumber: 1, Identifier: id}
+	}
+	fileDE := func(id string) DirectoryEntry {
+		return DirectoryEntry{ExtentLocation: 21, ExtentLength: int32(len(fileData)), VolumeSequenceNumber: 1, Identifier: id}
+	}
+	writeDir := func(sector int32, parent int32, entries ...DirectoryEntry) {
+		self := dirDE(string([]byte{0}), sector)
+		up := dirDE(string([]byte{1}), parent)
+		pos := int(sector) * int(sectorSize)
+		for _, de := range append([]DirectoryEntry{self, up}, entries...) {
+			data, err := de.MarshalBinary()
+			assert.NoError(t, err)
+			pos += copy(img[pos:], data)
+		}
+	}
+
+	for n, sector := range []int32{19, 20} {
+		root := dirDE(string([]byte{0}), sector)
+		vd := volumeDescriptor{
+			Header:  volumeDescriptorHeader{Type: volumeTypePrimary, Identifier: standardIdentifierBytes, Version: 1},
+			Primary: &PrimaryVolumeDescriptorBody{VolumeIdentifier: "JOLIET", VolumeSpaceSize: 24, VolumeSetSize: 1, VolumeSequenceNumber: 1, LogicalBlockSize: int16(sectorSize), RootDirectoryEntry: &root},
+		}
+		if n == 1 {
+			vd.Header.Type = volumeTypeSupplementary
+			copy(vd.Primary.EscapeSequences[:], "%/E")
+		}
+		data, err := vd.MarshalBinary()
+		assert.NoError(t, err)
+		copy(img[(16+n)*int(sectorSize):], data)
+	}
+	term, err := volumeDescriptor{Header: volumeDescriptorHeader{Type: volumeTypeTerminator, Identifier: standardIdentifierBytes, Version: 1}}.MarshalBinary()
+	assert.NoError(t, err)
+	copy(img[18*sectorSize:], term)
+
+	writeDir(19, 19, fileDE("LONG_FIL.TXT;1"), dirDE("SUB_DIR", 22))
+	writeDir(20, 20, fileDE(string(encodeUCS2("Long File Name Łódź.txt;1"))), dirDE(string(encodeUCS2("Sub Dir")), 23))
+	writeDir(22, 19, fileDE("INNER.DAT;1"))
+	writeDir(23, 20, fileDE(string(encodeUCS2("inner file.dat;1"))))
+	copy(img[21*sectorSize:], fileData)
+
+	return img
+}
+
+func TestImageReaderJoliet(t *testing.T) {
+	data := buildJolietTestImage(t)
+
+	image, err := OpenImage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.True(t, image.HasJoliet())
+
+	rootDir, err := image.RootDir()
+	assert.NoError(t, err)
+
+	children, err := rootDir.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 2) {
+		assert.Equal(t, "Long File Name Łódź.txt", children[0].Name())
+		content, err := ioutil.ReadAll(children[0].Reader())
+		assert.NoError(t, err)
+		assert.Equal(t, "hello joliet", string(content))
+
+		assert.Equal(t, "Sub Dir", children[1].Name())
+		sub, err := children[1].GetChildren()
+		assert.NoError(t, err)
+		if assert.Len(t, sub, 1) {
+			assert.Equal(t, "inner file.dat", sub[0].Name())
+		}
+	}
+
+	// forcing the primary tree
+	image, err = OpenImage(bytes.NewReader(data), IgnoreJoliet())
+	assert.NoError(t, err)
+
+	rootDir, err = image.RootDir()
+	assert.NoError(t, err)
+
+	children, err = rootDir.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 2) {
+		assert.Equal(t, "LONG_FIL.TXT", children[0].Name())
+		assert.Equal(t, "SUB_DIR", children[1].Name())
+	}
+}
@@ -10,22 +10,90 @@ import (
 	"os"
 	"path"
 	"runtime"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	primaryVolumeDirectoryIdentifierMaxLength = 31 // ECMA-119 7.6.3
 	primaryVolumeFileIdentifierMaxLength      = 30 // ECMA-119 7.5
+	relaxedIdentifierMaxLength                = 37 // mkisofs -max-iso9660-filenames
+
+	// limits of the hierarchy (ECMA-119 6.8.2.1), the root being level 1
+	maxDirectoryLevels = 8
+	maxPathLength      = 255
+
+	// maxFileSize is the size of the largest file that can be stored, as
+	// limited by the volume space size
+	maxFileSize = int64(math.MaxInt32) * int64(sectorSize)
 )
 
+// maxExtentLength is the length of the largest extent written for a file,
+// larger files are split in several sections (ECMA-119 6.5.1). It is a
+// multiple of the sector size so sections are contiguous.
+var maxExtentLength uint32 = math.MaxUint32 &^ (sectorSize - 1)
+
+// sectionCount returns the number of directory records of a file of the
+// given size
+func sectionCount(size int64) int {
+	if size <= int64(maxExtentLength) {
+		return 1
+	}
+	return int((size + int64(maxExtentLength) - 1) / int64(maxExtentLength))
+}
+
+// fileSections returns the directory records of a file of the given size
+// stored from the extent of de, with the multi-extent flag set on all
+// records but the last one
+func fileSections(de *DirectoryEntry, size int64) []*DirectoryEntry {
+	if sectionCount(size) == 1 {
+		return []*DirectoryEntry{de}
+	}
+
+	var res []*DirectoryEntry
+	// sections follow the extended attribute record of the first one
+	location := uint32(de.ExtentLocation)
+	ear := uint32(de.ExtendedAtributeRecordLength)
+	for size > 0 {
+		length := uint32(size)
+		if size > int64(maxExtentLength) {
+			length = maxExtentLength
+		}
+
+		section := de.Clone()
+		section.ExtendedAtributeRecordLength = byte(ear)
+		section.ExtentLocation = int32(location)
+		section.ExtentLength = int32(length)
+		if size > int64(length) {
+			section.FileFlags |= dirFlagMultiExtent
+		}
+		res = append(res, &section)
+
+		location += ear + length/sectorSize
+		size -= int64(length)
+		ear = 0
+	}
+	return res
+}
+
 var (
-	// ErrFileTooLarge is returned when trying to process a file of size greater
-	// than 4GB, which due to the 32-bit address limitation is not possible
-	// except with ISO 9660-Level 3
-	ErrFileTooLarge = errors.New("file is exceeding the maximum file size of 4GB")
+	// ErrFileTooLarge is returned when trying to process a file larger than
+	// the maximum volume size. Files larger than 4GB are split in several
+	// extents, as allowed by ISO 9660-Level 3, and are rejected at lower
+	// interchange levels.
+	ErrFileTooLarge = errors.New("file is exceeding the maximum file size")
 	ErrIsDir        = errors.New("is a directory")
+	// ErrRockRidgeRequired is returned when adding entries that can only be
+	// represented with Rock Ridge extensions, such as symbolic links
+	ErrRockRidgeRequired = errors.New("rock ridge extensions are required")
+	// ErrPathTooDeep is returned in strict mode for directories deeper than
+	// 8 levels, unless Rock Ridge extensions are enabled to relocate them
+	ErrPathTooDeep = errors.New("path is deeper than 8 levels")
+	// ErrPathTooLong is returned in strict mode for paths longer than 255
+	// characters once mangled
+	ErrPathTooLong = errors.New("path is longer than 255 characters")
 )
 
 // ImageWriter is responsible for staging an image's contents
@@ -33,10 +101,69 @@ var (
 type ImageWriter struct {
 	Primary *PrimaryVolumeDescriptorBody
 	Catalog string // Catalog is the path of the boot catalog on disk. Defaults to "BOOT.CAT"
-
-	root *itemDir
-	vd   []*volumeDescriptor
-	boot []*BootCatalogEntry // boot entries
+	Joliet  bool   // Joliet enables writing a Joliet supplementary volume with the original file names
+
+	// RockRidge enables writing Rock Ridge extensions in the primary volume,
+	// with original file names and POSIX attributes (see SetAttributes)
+	RockRidge bool
+
+	// OptionalPathTables enables writing the optional copies of the type L
+	// and type M path tables
+	OptionalPathTables bool
+
+	// IsoHybrid enables writing an isohybrid MBR in the system area, so
+	// images can also boot from USB sticks
+	IsoHybrid *IsoHybrid
+
+	// GPT enables writing a GUID partition table with an EFI system
+	// partition, so images can also boot from USB sticks on UEFI systems
+	GPT *GPT
+
+	// APM enables writing an Apple Partition Map, so images can also boot
+	// from USB sticks on Intel Macs
+	APM *APM
+
+	// Collisions is how files whose names are the same once mangled to ISO
+	// 9660 identifiers are told apart. Defaults to CollisionFail.
+	Collisions CollisionPolicy
+
+	// InterchangeLevel is the ISO 9660 interchange level of the image: level
+	// 1 restricts names to 8.3 characters, level 2 allows 30 characters and
+	// level 3 also allows files larger than 4GB, stored in several extents.
+	// Defaults to 3.
+	InterchangeLevel int
+	// Relaxations are deviations from the naming rules of InterchangeLevel
+	Relaxations Relaxations
+
+	// Strict makes adding entries and writing the image fail with
+	// ErrPathTooDeep or ErrPathTooLong when paths exceed the limits of
+	// ECMA-119. Directories deeper than 8 levels are relocated instead when
+	// RockRidge is enabled.
+	Strict bool
+
+	// SystemArea is written in the first 16 sectors of the image, such as a
+	// disk label or a boot loader. Partition tables are written on top of it.
+	SystemArea Item
+
+	// Reproducible makes written images only depend on their contents, so
+	// the same inputs always give the same image: volume dates are set to
+	// SourceDate, later modification times of entries are clamped to it,
+	// a system identifier left to its default is cleared, and the GPT disk
+	// GUID is derived from the image metadata unless set.
+	Reproducible bool
+	// SourceDate is the date of reproducible images. It defaults to the
+	// SOURCE_DATE_EPOCH environment variable if set, or to the Unix epoch.
+	SourceDate time.Time
+
+	root    *itemDir
+	changes int                 // incremented when the staged tree changes
+	boot    []*BootCatalogEntry // boot entries
+
+	appended []*appendedPartition // partitions stored after the image data
+
+	mangler   *mangler      // mangler of checkPath, see pathMangler
+	names     *mangledNames // identifiers of the staged tree, see MangledPath
+	namesLock sync.Mutex
 }
 
 // NewWriter creates a new ImageWrite.
@@ -49,7 +176,7 @@ func NewWriter() (*ImageWriter, error) {
 		VolumeSetSize:                 1,
 		VolumeSequenceNumber:          1,
 		LogicalBlockSize:              int16(sectorSize),
-		PathTableSize:                 0,
+		PathTableSize:                 0, // path tables are calculated upon finalization of disk
 		TypeLPathTableLoc:             0,
 		OptTypeLPathTableLoc:          0,
 		TypeMPathTableLoc:             0,
@@ -74,16 +201,6 @@ func NewWriter() (*ImageWriter, error) {
 		root:    newDir(),
 		Primary: Primary,
 		Catalog: "BOOT.CAT",
-		vd: []*volumeDescriptor{
-			{
-				Header: volumeDescriptorHeader{
-					Type:       volumeTypePrimary,
-					Identifier: standardIdentifierBytes,
-					Version:    1,
-				},
-				Primary: Primary,
-			},
-		},
 	}, nil
 }
 
@@ -92,21 +209,24 @@ func NewWriter() (*ImageWriter, error) {
 //
 // err = AddBootEntry(&BootCatalogEntry{BootInfoTable: true}, NewItemFile("syslinux/isolinux.bin"), "isolinux/isolinux.bin")
 func (iw *ImageWriter) AddBootEntry(boot *BootCatalogEntry, data Item, filePath string) error {
-	directoryPath, fileName := manglePath(filePath)
-
-	pos, err := iw.getDir(directoryPath)
+	item, err := NewItemReader(data)
 	if err != nil {
 		return err
 	}
 
-	if _, ok := pos.children[fileName]; ok {
-		// duplicate
-		return os.ErrExist
+	if err = boot.validate(item); err != nil {
+		return err
 	}
 
-	item, err := NewItemReader(data)
-	if err != nil {
-		return err
+	if boot.BootMedia == ElToritoHDD && boot.SystemType == 0 {
+		mbr, rest, err := peekItem(item, 512)
+		if err != nil {
+			return err
+		}
+		if err = boot.readSystemType(mbr); err != nil {
+			return err
+		}
+		item = rest
 	}
 
 	if boot.BootInfoTable {
@@ -117,9 +237,9 @@ func (iw *ImageWriter) AddBootEntry(boot *BootCatalogEntry, data Item, filePath
 		}
 	}
 
-	dirPath := path.Join(directoryPath, fileName)
-	item.meta().dirPath = dirPath
-	pos.children[fileName] = item
+	if err = iw.addItem(item, filePath); err != nil {
+		return err
+	}
 
 	boot.file = item
 
@@ -128,14 +248,12 @@ func (iw *ImageWriter) AddBootEntry(boot *BootCatalogEntry, data Item, filePath
 	return nil
 }
 
-func (iw *ImageWriter) getDir(directoryPath string) (*itemDir, error) {
-	dp := strings.Split(directoryPath, "/")
-	pos := iw.root
-	for _, seg := range dp {
-		if seg == "" {
-			continue
-		}
-		if v, ok := pos.children[seg]; ok {
+// getDir returns the directory matching the given (unmangled) path segments,
+// creating any missing directory on the way.
+func (d *itemDir) getDir(dirSegments []string) (*itemDir, error) {
+	pos := d
+	for _, name := range dirSegments {
+		if v, ok := pos.children[name]; ok {
 			if rV, ok := v.(*itemDir); ok {
 				pos = rV
 				continue
@@ -145,7 +263,8 @@ func (iw *ImageWriter) getDir(directoryPath string) (*itemDir, error) {
 		}
 		// not found → add
 		n := newDir()
-		pos.children[seg] = n
+		n.m.dirPath = path.Join(pos.m.dirPath, name)
+		pos.children[name] = n
 		pos = n
 	}
 
@@ -155,66 +274,241 @@ func (iw *ImageWriter) getDir(directoryPath string) (*itemDir, error) {
 // AddFile adds a file to the ImageWriter.
 // All path components are mangled to match basic ISO9660 filename requirements.
 func (iw *ImageWriter) AddFile(data io.Reader, filePath string) error {
-	directoryPath, fileName := manglePath(filePath)
+	item, err := NewItemReader(data)
+	if err != nil {
+		return err
+	}
+
+	return iw.addItem(item, filePath)
+}
+
+// addItem stores item at filePath in the staged tree, once its path is
+// checked
+func (iw *ImageWriter) addItem(item Item, filePath string) error {
+	if err := iw.checkPath(splitPath(path.Clean(filePath)), isDir(item)); err != nil {
+		return err
+	}
+	iw.changes++
+	return iw.root.addItem(item, filePath)
+}
+
+// pathMangler returns the mangler of the naming options of the writer, only
+// built again when they change
+func (iw *ImageWriter) pathMangler() (mangler, error) {
+	if m := iw.mangler; m != nil && m.level == iw.InterchangeLevel && m.Relaxations == iw.Relaxations {
+		return *m, nil
+	}
+	m, err := newMangler(iw.InterchangeLevel, iw.Relaxations)
+	if err != nil {
+		return m, err
+	}
+	iw.mangler = &m
+	return m, nil
+}
+
+// checkPath returns an error in strict mode if an entry at the given path
+// exceeds the limits of ECMA-119 6.8.2.1. Identifiers are computed without
+// collision suffixes, the final check being done when writing the image
+// (see checkPaths).
+func (iw *ImageWriter) checkPath(segments []string, dir bool) error {
+	if !iw.Strict {
+		return nil
+	}
+
+	dirs := len(segments) - 1
+	if dir {
+		dirs++
+	}
+	if 1+dirs > maxDirectoryLevels {
+		if iw.RockRidge {
+			// relocated, its path is checked once known
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrPathTooDeep, path.Join(segments...))
+	}
 
-	pos, err := iw.getDir(directoryPath)
+	m, err := iw.pathMangler()
 	if err != nil {
 		return err
 	}
+	length := len(segments) - 1 // separators
+	for i, name := range segments {
+		if i < dirs {
+			length += len(m.dirName(name, ""))
+		} else {
+			length += len(m.fileName(name, ""))
+		}
+	}
+	if length > maxPathLength {
+		return fmt.Errorf("%w: %s", ErrPathTooLong, path.Join(segments...))
+	}
+	return nil
+}
 
-	if _, ok := pos.children[fileName]; ok {
-		// duplicate
-		return os.ErrExist
+// checkPaths returns an error in strict mode if the rendered tree starting
+// at root exceeds the limits of ECMA-119 6.8.2.1
+func (wc *writeContext) checkPaths(root *itemDir) error {
+	if !wc.iw.Strict {
+		return nil
 	}
 
-	item, err := NewItemReader(data)
+	var walk func(dir *itemDir, level int, dirPath string) error
+	walk = func(dir *itemDir, level int, dirPath string) error {
+		for _, name := range dir.sortedNames() {
+			c := dir.children[name]
+			filePath := path.Join(dirPath, name)
+			if len(filePath) > maxPathLength {
+				return fmt.Errorf("%w: %s", ErrPathTooLong, c.meta().dirPath)
+			}
+			sub, ok := c.(*itemDir)
+			if !ok {
+				continue
+			}
+			if level >= maxDirectoryLevels {
+				return fmt.Errorf("%w: %s", ErrPathTooDeep, c.meta().dirPath)
+			}
+			if err := walk(sub, level+1, filePath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, 1, "")
+}
+
+// addItem stores item at filePath. Staged directories are indexed by
+// original names, which are only mangled when writing the image (see
+// mangleNames).
+func (d *itemDir) addItem(item Item, filePath string) error {
+	segments := splitPath(path.Clean(filePath))
+	if len(segments) == 0 {
+		return os.ErrInvalid
+	}
+	name := segments[len(segments)-1]
+
+	pos, err := d.getDir(segments[:len(segments)-1])
 	if err != nil {
 		return err
 	}
 
-	dirPath := path.Join(directoryPath, fileName)
-	item.meta().dirPath = dirPath
-	pos.children[fileName] = item
+	if _, ok := pos.children[name]; ok {
+		// duplicate
+		return os.ErrExist
+	}
+
+	item.meta().dirPath = path.Join(pos.m.dirPath, name)
+	pos.children[name] = item
 	return nil
 }
 
+// withItem returns a copy of d with item stored at filePath, directories on
+// the way being copied so that d is left untouched
+func (d *itemDir) withItem(item Item, filePath string) (*itemDir, error) {
+	segments := splitPath(path.Clean(filePath))
+	if len(segments) == 0 {
+		return nil, os.ErrInvalid
+	}
+
+	res := d.shallowCopy()
+	pos := res
+	for _, name := range segments[:len(segments)-1] {
+		v, ok := pos.children[name]
+		if !ok {
+			break
+		}
+		sub, ok := v.(*itemDir)
+		if !ok {
+			return nil, ErrIsDir
+		}
+		sub = sub.shallowCopy()
+		pos.children[name] = sub
+		pos = sub
+	}
+
+	if err := res.addItem(item, filePath); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// shallowCopy returns a copy of d sharing its children
+func (d *itemDir) shallowCopy() *itemDir {
+	res := newDir()
+	res.m = d.m.staged()
+	for name, c := range d.children {
+		res.children[name] = c
+	}
+	return res
+}
+
 // AddLocalFile adds a file to the ImageWriter from the local filesystem.
 // localPath must be an existing and readable file, and filePath will be the path
 // on the ISO image.
 func (iw *ImageWriter) AddLocalFile(localPath, filePath string) error {
-	buf, err := NewItemFile(localPath)
+	st, err := os.Lstat(localPath)
 	if err != nil {
 		return fmt.Errorf("unable to add local file: %w", err)
 	}
 
-	return iw.AddFile(buf, filePath)
-}
+	if iw.RockRidge && st.Mode()&(os.ModeSymlink|os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+		// special files are stored as is
+		item := &itemNode{}
+		if st.Mode()&os.ModeSymlink != 0 {
+			if item.target, err = os.Readlink(localPath); err != nil {
+				return fmt.Errorf("unable to add local file: %w", err)
+			}
+		}
+		item.m.attr = attributesFromFileInfo(st)
+		return iw.addItem(item, filePath)
+	}
 
-func recursiveDirSectorCount(dir *itemDir) uint32 {
-	// count sectors required for everything in a given dir (typically root)
-	sec := dir.sectors() // own data space
+	buf, err := NewItemFile(localPath)
+	if err != nil {
+		return fmt.Errorf("unable to add local file: %w", err)
+	}
 
-	for _, sub := range dir.children {
-		switch v := sub.(type) {
-		case *itemDir:
-			sec += recursiveDirSectorCount(v)
-		default:
-			sec += v.sectors()
+	if st.Mode()&os.ModeSymlink != 0 {
+		// link is followed, use the target's attributes
+		if st, err = os.Stat(localPath); err != nil {
+			return fmt.Errorf("unable to add local file: %w", err)
 		}
 	}
 
-	return sec
+	if err = iw.AddFile(buf, filePath); err != nil {
+		return err
+	}
+	buf.meta().attr = attributesFromFileInfo(st)
+	return nil
 }
 
+// writeContext holds the layout of an image for a single write, computed
+// from a copy of the staged tree of the ImageWriter (see render)
 type writeContext struct {
 	iw                *ImageWriter
 	w                 io.Writer
-	timestamp         RecordingTimestamp
+	primary           *PrimaryVolumeDescriptorBody // copy of the primary volume descriptor
+	joliet            *PrimaryVolumeDescriptorBody // Joliet supplementary volume, if any
+	root              *itemDir                     // rendered tree
+	boot              []*BootCatalogEntry          // boot entries, pointing to rendered items
+	rendered          map[Item]Item                // rendered items by staged item
+	mangler           mangler                      // mangles names according to the interchange level
+	timestamp         RecordingTimestamp           // volume creation time
+	sourceDate        time.Time                    // date of reproducible images
 	freeSectorPointer uint32
 	itemsToWrite      *list.List // simple fifo used during
 	items             []Item     // items in the right order for final write
 	writeSecPos       uint32
-	emptySector       []byte // a sector-sized buffer of zeroes
+	emptySector       []byte       // a sector-sized buffer of zeroes
+	gptBackup         *bufferHndlr // backup GPT at the end of the image, if any
+	area              []byte       // system area
+	vd                []*volumeDescriptor
+	bootCatalog       Item   // boot catalog, if any
+	metadata          []Item // items allocated with allocMetadata
+
+	// directories relocated by Rock Ridge, see relocateDirectories
+	rrMoved   *itemDir              // directory holding relocated directories
+	relocated map[Item]*itemDir     // relocated directories by placeholder
+	parents   map[*itemDir]*itemDir // original parents of relocated directories
 }
 
 // allocSectors will allocate a number of sectors and return the first free position
@@ -227,15 +521,23 @@ func (wc *writeContext) allocSectors(it Item) uint32 {
 	return res
 }
 
-func (wc *writeContext) createDEForRoot() (*DirectoryEntry, error) {
-	extentLengthInSectors := wc.iw.root.sectors()
+// allocMetadata allocates it like allocSectors, keeping track of it as
+// metadata of the image: directories, path tables, continuation areas and
+// extended attribute records
+func (wc *writeContext) allocMetadata(it Item) uint32 {
+	wc.metadata = append(wc.metadata, it)
+	return wc.allocSectors(it)
+}
+
+func (wc *writeContext) createDEForRoot(root *itemDir) (*DirectoryEntry, error) {
+	extentLengthInSectors := root.sectors()
 
-	extentLocation := wc.allocSectors(wc.iw.root)
+	extentLocation := wc.allocMetadata(root)
 	de := &DirectoryEntry{
 		ExtendedAtributeRecordLength: 0,
 		ExtentLocation:               int32(extentLocation),
 		ExtentLength:                 int32(extentLengthInSectors * sectorSize),
-		RecordingDateTime:            wc.timestamp,
+		RecordingDateTime:            wc.recordingTime(root),
 		FileFlags:                    dirFlagDir,
 		FileUnitSize:                 0, // 0 for non-interleaved write
 		InterleaveGap:                0, // not interleaved
@@ -250,10 +552,16 @@ func (wc *writeContext) processDirectory(dir *itemDir, ownEntry *DirectoryEntry,
 	buf := dir.buf
 	bufPos := 0
 
+	// System Use fields, if any, must be computed before children get
+	// allocated so continuation areas are located right after the directory
+	systemUse := wc.systemUseFields(dir)
+
 	currentDE := ownEntry.Clone()
 	currentDE.Identifier = string([]byte{0})
+	currentDE.SystemUse = systemUse[currentDE.Identifier]
 	parentDE := parentEntry.Clone()
 	parentDE.Identifier = string([]byte{1})
+	parentDE.SystemUse = systemUse[parentDE.Identifier]
 
 	currentDEData, err := currentDE.MarshalBinary()
 	if err != nil {
@@ -277,42 +585,51 @@ func (wc *writeContext) processDirectory(dir *itemDir, ownEntry *DirectoryEntry,
 	bufPos += n
 
 	// here we need to proceed in alphabetical order so tests aren't broken
-	names := make([]string, 0, len(dir.children))
-	for name := range dir.children {
-		names = append(names, name)
-	}
-	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
-
-	for _, name := range names {
+	for _, name := range dir.sortedNames() {
 		c := dir.children[name]
 
-		var (
-			fileFlags    byte
-			extentLength uint32
-		)
+		var fileFlags byte
 
 		var de *DirectoryEntry
-		if c.Size() > int64(math.MaxUint32) {
+		if c.Size() > maxFileSize || c.Size() > int64(maxExtentLength) && !wc.multiExtent() {
 			return ErrFileTooLarge
 		}
-		extentLength = uint32(c.Size())
+		// length of the first section for files larger than an extent
+		extentLength := uint32(c.Size())
+		if c.Size() > int64(maxExtentLength) {
+			extentLength = maxExtentLength
+		}
 
 		if _, ok := c.(*itemDir); ok {
 			// this is a directory
 			fileFlags = dirFlagDir
-		} else {
-			de = c.meta().ownEntry // grab de in case file was already included in disk
-			fileFlags = 0
+		} else if own := c.meta().ownEntry; own != nil {
+			// file was already included in disk (hard link or Joliet tree),
+			// reuse its extent under this entry's name
+			clone := own.Clone()
+			clone.Identifier = name
+			clone.SystemUse = systemUse[name]
+			de = &clone
 		}
 
 		if de == nil {
-			extentLocation := wc.allocSectors(c)
+			// the extended attribute record, if any, starts the extent
+			extentLocation := wc.freeSectorPointer
+			earLength, err := wc.allocExtendedAttributes(c)
+			if err != nil {
+				return err
+			}
+			if fileFlags&dirFlagDir != 0 {
+				wc.allocMetadata(c)
+			} else {
+				wc.allocSectors(c)
+			}
 			de = &DirectoryEntry{
-				ExtendedAtributeRecordLength: 0,
+				ExtendedAtributeRecordLength: earLength,
 				ExtentLocation:               int32(extentLocation),
 				ExtentLength:                 int32(extentLength),
-				RecordingDateTime:            wc.timestamp,
-				FileFlags:                    fileFlags,
+				RecordingDateTime:            wc.recordingTime(c),
+				FileFlags:                    fileFlags | wc.recordFlags(c),
 				FileUnitSize:                 0, // 0 for non-interleaved write
 				InterleaveGap:                0, // not interleaved
 				VolumeSequenceNumber:         1, // we only have one volume
@@ -322,29 +639,40 @@ func (wc *writeContext) processDirectory(dir *itemDir, ownEntry *DirectoryEntry,
 
 			c.meta().set(de, ownEntry)
 
+			if su, ok := systemUse[name]; ok {
+				// record-specific, ownEntry is also used for "." and ".."
+				clone := de.Clone()
+				clone.SystemUse = su
+				de = &clone
+			}
+
 			// queue this child for processing if directory
-			if fileFlags == dirFlagDir {
+			if fileFlags&dirFlagDir != 0 {
 				wc.itemsToWrite.PushBack(c)
 			}
 		}
 
-		data, err := de.MarshalBinary()
-		if err != nil {
-			return err
-		}
+		// files larger than an extent get one record per section
+		for _, section := range fileSections(de, c.Size()) {
+			data, err := section.MarshalBinary()
+			if err != nil {
+				return err
+			}
 
-		if uint32(bufPos+len(data)) > sectorSize {
-			// unless we reached the exact end of the sector
-			if uint32(bufPos) < sectorSize {
-				// need to add some bytes
-				buf.Write(wc.emptySector[:sectorSize-uint32(bufPos)])
+			if uint32(bufPos+len(data)) > sectorSize {
+				// unless we reached the exact end of the sector
+				if uint32(bufPos) < sectorSize {
+					// need to add some bytes
+					buf.Write(wc.emptySector[:sectorSize-uint32(bufPos)])
+				}
+				bufPos = 0
 			}
-			bufPos = 0
-		}
 
-		_, err = buf.Write(data)
-		if err != nil {
-			return err
+			n, err = buf.Write(data)
+			if err != nil {
+				return err
+			}
+			bufPos += n
 		}
 	}
 
@@ -352,23 +680,103 @@ func (wc *writeContext) processDirectory(dir *itemDir, ownEntry *DirectoryEntry,
 }
 
 func (wc *writeContext) processAll() error {
+	var jolietRoot *itemDir
+	if wc.joliet != nil {
+		// Joliet directories point to the same file extents as the primary
+		// hierarchy, before any relocation
+		jolietRoot = newJolietTree(wc.root)
+	}
+
+	if wc.iw.RockRidge {
+		if err := wc.relocateDirectories(wc.root); err != nil {
+			return err
+		}
+		wc.prepareRockRidge(wc.root)
+	}
+	if err := wc.checkPaths(wc.root); err != nil {
+		return err
+	}
+
+	// Path tables are located before directories, their contents are
+	// generated once all directories have been allocated
+	tables, err := wc.reservePathTables(wc.primary, wc.root)
+	if err != nil {
+		return err
+	}
+	var jolietTables *pathTables
+	if jolietRoot != nil {
+		if jolietTables, err = wc.reservePathTables(wc.joliet, jolietRoot); err != nil {
+			return err
+		}
+	}
+
 	// Generate disk header
-	rootDE, err := wc.createDEForRoot()
+	rootDE, err := wc.createDEForRoot(wc.root)
 	if err != nil {
 		return fmt.Errorf("creating root directory descriptor: %s", err)
 	}
 
 	// store rootDE pointer in primary
-	wc.iw.Primary.RootDirectoryEntry = rootDE
-	wc.iw.root.meta().set(rootDE, rootDE)
+	wc.primary.RootDirectoryEntry = rootDE
+	wc.root.meta().set(rootDE, rootDE)
 
 	// Write disk data
-	wc.itemsToWrite.PushBack(wc.iw.root)
+	if err = wc.processTree(wc.root); err != nil {
+		return err
+	}
+	tables.fill()
+
+	if jolietRoot != nil {
+		// Joliet directories are written after the primary hierarchy
+		rootDE, err := wc.createDEForRoot(jolietRoot)
+		if err != nil {
+			return fmt.Errorf("creating joliet root directory descriptor: %s", err)
+		}
+
+		wc.joliet.RootDirectoryEntry = rootDE
+		jolietRoot.meta().set(rootDE, rootDE)
+
+		if err = wc.processTree(jolietRoot); err != nil {
+			return err
+		}
+		jolietTables.fill()
+	}
+
+	if a := wc.iw.APM; a != nil && a.HFSPlus != nil {
+		// the HFS+ image is only reachable from the partition tables
+		wc.allocSectors(wc.render(a.HFSPlus))
+	}
+	if wc.iw.IsoHybrid != nil {
+		wc.padIsoHybrid()
+	}
+	for _, p := range wc.iw.appended {
+		wc.allocSectors(wc.render(p.item))
+	}
+
+	if wc.iw.GPT != nil {
+		// the backup GPT ends the image, it is filled with the system area
+		wc.gptBackup = &bufferHndlr{d: make([]byte, gptBackupSectors*sectorSize)}
+		wc.allocSectors(wc.gptBackup)
+	}
+
+	return nil
+}
+
+// processTree allocates and generates the directory records of root and all
+// its subdirectories, in breadth-first order
+func (wc *writeContext) processTree(root *itemDir) error {
+	wc.itemsToWrite.PushBack(root)
 
 	for item := wc.itemsToWrite.Front(); wc.itemsToWrite.Len() > 0; item = wc.itemsToWrite.Front() {
 		it := item.Value.(Item)
 		var err error
 		if cV, ok := it.(*itemDir); ok {
+			if p, ok := wc.parents[cV]; ok && p.meta().ownEntry == nil {
+				// the PL entry of a relocated directory points to its
+				// original parent, which must be allocated first
+				wc.itemsToWrite.MoveToBack(item)
+				continue
+			}
 			err = wc.processDirectory(cV, it.meta().ownEntry, it.meta().parentEntry, it.meta().targetSector)
 
 			if err != nil {
@@ -421,8 +829,8 @@ func (wc *writeContext) writeSectorBuf(buf Item) error {
 		return err
 	}
 
-	secCnt := uint32(n) / sectorSize
-	if secBytes := uint32(n) % sectorSize; secBytes != 0 {
+	secCnt := uint32(n / int64(sectorSize))
+	if secBytes := uint32(n % int64(sectorSize)); secBytes != 0 {
 		secCnt += 1
 		// add zeroes using wc.emptySector (which is a sector-sized buffer of zeroes)
 		extra := sectorSize - secBytes
@@ -441,29 +849,79 @@ func (wc *writeContext) writeDescriptor(pvd *volumeDescriptor, sector uint32) er
 	}
 }
 
-func (iw *ImageWriter) WriteTo(w io.Writer) error {
-	vd := iw.vd
+// prepare lays out the image: it allocates all items and generates the
+// system area, volume descriptors, directories and tables, so the image can
+// then be written or read. The layout is kept in a new writeContext, with its
+// own copy of the tree and descriptors, so the ImageWriter is left untouched.
+func (iw *ImageWriter) prepare() (*writeContext, error) {
+	primary := *iw.Primary
+	var sourceDate time.Time
+	if iw.Reproducible {
+		var err error
+		if sourceDate, err = iw.sourceDate(); err != nil {
+			return nil, err
+		}
+		date := VolumeDescriptorTimestampFromTime(sourceDate)
+		primary.VolumeCreationDateAndTime = date
+		primary.VolumeModificationDateAndTime = date
+		primary.VolumeEffectiveDateAndTime = date
+		if primary.SystemIdentifier == runtime.GOOS {
+			primary.SystemIdentifier = ""
+		}
+	}
+	vd := []*volumeDescriptor{
+		{
+			Header: volumeDescriptorHeader{
+				Type:       volumeTypePrimary,
+				Identifier: standardIdentifierBytes,
+				Version:    1,
+			},
+			Primary: &primary,
+		},
+	}
+
+	wc := &writeContext{
+		iw:           iw,
+		primary:      &primary,
+		timestamp:    RecordingTimestamp(primary.VolumeCreationDateAndTime.Time()),
+		sourceDate:   sourceDate,
+		itemsToWrite: list.New(),
+		writeSecPos:  0,
+		emptySector:  make([]byte, sectorSize),
+		rendered:     make(map[Item]Item),
+	}
+
+	// boot images are rendered first, so images getting a boot info table
+	// are copied before the tree gets rendered
+	for _, b := range iw.boot {
+		entry := *b
+		if b.BootInfoTable {
+			f := b.file.(*bufferHndlr)
+			wc.rendered[b.file] = &bufferHndlr{d: append([]byte(nil), f.d...), m: f.m.staged()}
+		}
+		entry.file = wc.render(b.file)
+		wc.boot = append(wc.boot, &entry)
+	}
+
 	var (
 		err error
 		// variables used for boot
-		boot        *BootVolumeDescriptorBody
-		bootCat     []byte
-		bootCatInfo Item
+		boot    *BootVolumeDescriptorBody
+		bootCat []byte
 	)
 
-	if len(iw.boot) > 0 {
+	if len(wc.boot) > 0 {
 		// we need a boot catalog, store info
 		boot = &BootVolumeDescriptorBody{
-			BootSystemIdentifier: "EL TORITO SPECIFICATION",
+			BootSystemIdentifier: elToritoSystemIdentifier,
 		}
-		bootCat = make([]byte, 2048)
-		bootCatInfo = &bufferHndlr{d: bootCat}
-
-		// add boot catalog
-		err = iw.AddFile(bootCatInfo, iw.Catalog)
+		data, err := encodeBootCatalogs(wc.boot)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		bootCat = make([]byte, len(data))
+		wc.bootCatalog = &bufferHndlr{d: bootCat}
+		wc.rendered[wc.bootCatalog] = wc.bootCatalog
 
 		vd = append(vd, &volumeDescriptor{
 			Header: volumeDescriptorHeader{
@@ -475,6 +933,18 @@ func (iw *ImageWriter) WriteTo(w io.Writer) error {
 		})
 	}
 
+	if iw.Joliet {
+		wc.joliet = jolietDescriptor(&primary)
+		vd = append(vd, &volumeDescriptor{
+			Header: volumeDescriptorHeader{
+				Type:       volumeTypeSupplementary,
+				Identifier: standardIdentifierBytes,
+				Version:    1,
+			},
+			Primary: wc.joliet,
+		})
+	}
+
 	// generate vd list with terminator
 	vd = append(vd, &volumeDescriptor{
 		Header: volumeDescriptorHeader{
@@ -483,62 +953,229 @@ func (iw *ImageWriter) WriteTo(w io.Writer) error {
 			Version:    1,
 		},
 	})
+	wc.vd = vd
+	wc.freeSectorPointer = uint32(16 + len(vd)) // system area (16) + descriptors
 
-	wc := writeContext{
-		iw:                iw,
-		w:                 w,
-		timestamp:         RecordingTimestamp{},
-		freeSectorPointer: uint32(16 + len(vd)), // system area (16) + descriptors
-		itemsToWrite:      list.New(),
-		writeSecPos:       0,
-		emptySector:       make([]byte, sectorSize),
+	// render the tree, along with the boot catalog
+	if wc.mangler, err = newMangler(iw.InterchangeLevel, iw.Relaxations); err != nil {
+		return nil, err
+	}
+	root, err := iw.tree(wc.bootCatalog)
+	if err != nil {
+		return nil, err
+	}
+	if wc.root, err = wc.renderDir(root); err != nil {
+		return nil, err
 	}
-
-	// configure volume space size
-	iw.Primary.VolumeSpaceSize = int32(16 + uint32(len(vd)) + recursiveDirSectorCount(iw.root))
 
 	// processAll() will prepare the data to be written, including offsets, etc.
 	if err = wc.processAll(); err != nil {
-		return fmt.Errorf("writing files: %s", err)
+		return nil, fmt.Errorf("writing files: %w", err)
+	}
+
+	// configure volume space size
+	primary.VolumeSpaceSize = int32(wc.freeSectorPointer)
+	if wc.joliet != nil {
+		wc.joliet.VolumeSpaceSize = primary.VolumeSpaceSize
 	}
 
-	if len(iw.boot) > 0 {
+	if len(wc.boot) > 0 {
 		// we have a boot catalog to make!
 		// First, grab the location of boot catalog and store in boot record
-		binary.LittleEndian.PutUint32(boot.BootSystemUse[:4], bootCatInfo.meta().targetSector)
+		binary.LittleEndian.PutUint32(boot.BootSystemUse[:4], wc.bootCatalog.meta().targetSector)
 
 		// generate catalog
-		data, err := encodeBootCatalogs(iw.boot)
+		data, err := encodeBootCatalogs(wc.boot)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// overwrite bootCat with data so it will be written to disk
 		copy(bootCat, data)
+
+		for _, b := range wc.boot {
+			if b.BootInfoTable {
+				b.performInfoTable()
+			}
+		}
 	}
 
-	// write 16 sectors of zeroes
-	for i := uint32(0); i < 16; i++ {
-		if err = wc.writeSector(wc.emptySector, i); err != nil {
-			return err
+	// generate the 16 sectors of system area
+	if wc.area, err = wc.systemArea(); err != nil {
+		return nil, err
+	}
+
+	return wc, nil
+}
+
+// WriteTo writes the image to w, following the layout returned by Plan. It
+// can be called several times, including concurrently, as long as the
+// contents of the writer are not changed meanwhile.
+func (iw *ImageWriter) WriteTo(w io.Writer) error {
+	plan, err := iw.Plan()
+	if err != nil {
+		return err
+	}
+	_, err = plan.WriteTo(w)
+	return err
+}
+
+// jolietDescriptor returns a Joliet supplementary volume descriptor body
+// matching the primary volume descriptor
+func jolietDescriptor(primary *PrimaryVolumeDescriptorBody) *PrimaryVolumeDescriptorBody {
+	res := *primary
+	copy(res.EscapeSequences[:], jolietEscapeSequences[2]) // UCS-2 level 3
+
+	res.SystemIdentifier = jolietString(primary.SystemIdentifier, 32)
+	res.VolumeIdentifier = jolietString(primary.VolumeIdentifier, 32)
+	res.VolumeSetIdentifier = jolietString(primary.VolumeSetIdentifier, 128)
+	res.PublisherIdentifier = jolietString(primary.PublisherIdentifier, 128)
+	res.DataPreparerIdentifier = jolietString(primary.DataPreparerIdentifier, 128)
+	res.ApplicationIdentifier = jolietString(primary.ApplicationIdentifier, 128)
+	res.CopyrightFileIdentifier = jolietString(primary.CopyrightFileIdentifier, 38)
+	res.AbstractFileIdentifier = jolietString(primary.AbstractFileIdentifier, 36)
+	res.BibliographicFileIdentifier = jolietString(primary.BibliographicFileIdentifier, 37)
+
+	return &res
+}
+
+// sourceDate returns the date of reproducible images
+func (iw *ImageWriter) sourceDate() (time.Time, error) {
+	if !iw.SourceDate.IsZero() {
+		return iw.SourceDate.UTC(), nil
+	}
+	date, err := sourceDateEpoch()
+	if err != nil || !date.IsZero() {
+		return date, err
+	}
+	return time.Unix(0, 0).UTC(), nil
+}
+
+// sourceDateEpoch returns the date set by the SOURCE_DATE_EPOCH environment
+// variable, or a zero time if it is not set
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %s", err)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// recordingTime returns the date of the directory record of an item
+func (wc *writeContext) recordingTime(it Item) RecordingTimestamp {
+	return RecordingTimestamp(wc.attributes(it).ModTime)
+}
+
+// tree returns the staged tree, along with catalog stored at the path of the
+// boot catalog if the image is bootable
+func (iw *ImageWriter) tree(catalog Item) (*itemDir, error) {
+	if len(iw.boot) == 0 {
+		return iw.root, nil
+	}
+	return iw.root.withItem(catalog, iw.Catalog)
+}
+
+// mangledNames holds the paths of the ISO 9660 identifiers of the entries of
+// a render of the staged tree, by original path
+type mangledNames struct {
+	key   namingKey
+	paths map[string]string
+	err   error
+}
+
+// namingKey is the state of the writer the identifiers of a render depend on
+type namingKey struct {
+	changes    int
+	level      int
+	relax      Relaxations
+	collisions CollisionPolicy
+	rockRidge  bool
+	catalog    string
+}
+
+// MangledPath returns the path of the ISO 9660 identifiers a file or
+// directory previously added to the image is written with, such as
+// "DIR/FOO_BAR~01.TXT;1". Identifiers are computed according to Collisions.
+// With Rock Ridge, paths within directories deeper than 8 levels start from
+// the RR_MOVED directory they are relocated to, such as "RR_MOVED/I/FILE.TXT;1".
+func (iw *ImageWriter) MangledPath(filePath string) (string, error) {
+	iw.namesLock.Lock()
+	defer iw.namesLock.Unlock()
+
+	// the tree is only rendered again once changed
+	key := namingKey{iw.changes, iw.InterchangeLevel, iw.Relaxations, iw.Collisions, iw.RockRidge, iw.Catalog}
+	if iw.names == nil || iw.names.key != key {
+		paths, err := iw.mangledPaths()
+		iw.names = &mangledNames{key: key, paths: paths, err: err}
+	}
+	if iw.names.err != nil {
+		return "", iw.names.err
+	}
+
+	res, ok := iw.names.paths[strings.Join(splitPath(path.Clean(filePath)), "/")]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return res, nil
+}
+
+// mangledPaths renders the staged tree and returns the paths of the ISO 9660
+// identifiers of its entries, by original path
+func (iw *ImageWriter) mangledPaths() (map[string]string, error) {
+	wc := &writeContext{iw: iw, rendered: make(map[Item]Item)}
+	var err error
+	if wc.mangler, err = iw.pathMangler(); err != nil {
+		return nil, err
+	}
+	tree, err := iw.tree(&bufferHndlr{})
+	if err != nil {
+		return nil, err
+	}
+	root, err := wc.renderDir(tree)
+	if err != nil {
+		return nil, err
+	}
+	if iw.RockRidge {
+		if err = wc.relocateDirectories(root); err != nil {
+			return nil, err
 		}
 	}
 
-	// write volume descriptors
-	for i, pvd := range vd {
-		if err = wc.writeDescriptor(pvd, uint32(16+i)); err != nil {
-			return err
+	moved := make(map[Item]string) // identifiers within RR_MOVED
+	if wc.rrMoved != nil {
+		for id, c := range wc.rrMoved.children {
+			moved[c] = id
 		}
 	}
 
-	// this actually writes the data to the disk
-	for _, buf := range wc.items {
-		err = wc.writeSectorBuf(buf)
-		if err != nil {
-			return err
+	res := map[string]string{"": ""}
+	var walk func(dir *itemDir, name, id string)
+	walk = func(dir *itemDir, name, id string) {
+		for cID, c := range dir.children {
+			if wc.rrMoved != nil && c == Item(wc.rrMoved) {
+				// only reachable through relocated directories
+				continue
+			}
+			cName, cPath := path.Join(name, dir.names[cID]), path.Join(id, cID)
+			if sub, ok := wc.relocated[c]; ok {
+				// continue from the relocated directory
+				c, cPath = sub, path.Join(rrMovedIdentifier, moved[sub])
+			}
+			res[cName] = cPath
+			if sub, ok := c.(*itemDir); ok {
+				walk(sub, cName, cPath)
+			}
 		}
-		buf.Close()
 	}
+	walk(root, "", "")
+	return res, nil
+}
 
-	return nil
+// multiExtent returns true if files can be stored in several extents
+func (wc *writeContext) multiExtent() bool {
+	return wc.iw.InterchangeLevel == 0 || wc.iw.InterchangeLevel >= 3
 }
@@ -1,14 +1,28 @@
 package iso9660
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+func defaultMangler(t *testing.T) mangler {
+	m, err := newMangler(0, Relaxations{})
+	assert.NoError(t, err)
+	return m
+}
+
 func TestMangleDirectoryName(t *testing.T) {
 	for _, testcase := range []struct {
 		input  string
@@ -28,7 +42,7 @@ func TestMangleDirectoryName(t *testing.T) {
 		},
 	} {
 		t.Run(testcase.input, func(t *testing.T) {
-			o := mangleDirectoryName(testcase.input)
+			o := defaultMangler(t).dirName(testcase.input, "")
 			assert.Equal(t, testcase.output, o)
 		})
 	}
@@ -57,7 +71,7 @@ func TestMangleFileName(t *testing.T) {
 		},
 	} {
 		t.Run(testcase.input, func(t *testing.T) {
-			o := mangleFileName(testcase.input)
+			o := defaultMangler(t).fileName(testcase.input, "")
 			assert.Equal(t, testcase.output, o)
 		})
 	}
@@ -132,3 +146,651 @@ func TestWriter(t *testing.T) {
 
 	assert.Equal(t, largeFileData, readData)
 }
+
+func TestWriterJoliet(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.Joliet = true
+
+	longName := strings.Repeat("VeryLongName", 6) + ".txt"
+	files := map[string]string{
+		"Driver Files/Setup Installer.exe": "setup",
+		"Driver Files/" + longName:         "long1",
+		"Driver Files/Other" + longName:    "long2",
+		"Ünïcødé/naïve.txt":                "unicode",
+	}
+	for name, content := range files {
+		assert.NoError(t, w.AddFile(strings.NewReader(content), name))
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	img, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, img.HasJoliet())
+
+	root, err := img.RootDir()
+	assert.NoError(t, err)
+
+	children, err := root.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 2) {
+		assert.Equal(t, "Driver Files", children[0].Name())
+		assert.Equal(t, "Ünïcødé", children[1].Name())
+
+		drivers, err := children[0].GetChildren()
+		assert.NoError(t, err)
+		found := make(map[string]string)
+		for _, c := range drivers {
+			data, err := ioutil.ReadAll(c.Reader())
+			assert.NoError(t, err)
+			found[c.Name()] = string(data)
+			assert.LessOrEqual(t, len([]rune(c.Name())), 64)
+		}
+		assert.Len(t, found, 3)
+		assert.Equal(t, "setup", found["Setup Installer.exe"])
+
+		unicode, err := children[1].GetChildren()
+		assert.NoError(t, err)
+		if assert.Len(t, unicode, 1) {
+			assert.Equal(t, "naïve.txt", unicode[0].Name())
+			data, err := ioutil.ReadAll(unicode[0].Reader())
+			assert.NoError(t, err)
+			assert.Equal(t, "unicode", string(data))
+		}
+	}
+
+	// the primary tree uses the same file extents
+	primary, err := img.PrimaryRootDir()
+	assert.NoError(t, err)
+	children, err = primary.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 2) {
+		assert.Equal(t, "DRIVER_FILES", children[0].Name())
+	}
+}
+
+func TestJolietNameCollision(t *testing.T) {
+	d := newDir()
+	long := strings.Repeat("a", 70)
+	d.children["A1;1"] = &bufferHndlr{}
+	d.names["A1;1"] = long + "1.txt"
+	d.children["A2;1"] = &bufferHndlr{}
+	d.names["A2;1"] = long + "2.txt"
+
+	names := jolietNames(d)
+	assert.Equal(t, strings.Repeat("a", 60)+".txt", names["A1;1"])
+	assert.Equal(t, strings.Repeat("a", 58)+"~1.txt", names["A2;1"])
+}
+
+func TestWriterLargeDirectory(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+
+	// enough entries for the directory to span several sectors
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, w.AddFile(strings.NewReader("data"), fmt.Sprintf("dir/file_with_long_name_%03d.txt", i)))
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	img, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	root, err := img.RootDir()
+	assert.NoError(t, err)
+	children, err := root.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 1) {
+		children, err = children[0].GetChildren()
+		assert.NoError(t, err)
+		assert.Len(t, children, 200)
+	}
+}
+
+func TestWriterMultiExtent(t *testing.T) {
+	// use small extents, so that files don't need to be larger than 4GB
+	defer func(length uint32) { maxExtentLength = length }(maxExtentLength)
+	maxExtentLength = 4 * sectorSize
+
+	content := make([]byte, 10*sectorSize+100)
+	for i := range content {
+		content[i] = byte(i / 7)
+	}
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.Joliet = true
+	w.RockRidge = true
+	assert.NoError(t, w.AddFile(bytes.NewReader(content), "data/large.bin"))
+	assert.NoError(t, w.AddFile(bytes.NewReader(content[:4*sectorSize]), "data/single.bin"))
+	assert.NoError(t, w.AddFile(strings.NewReader("after"), "data/zzz.txt"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	for _, opts := range [][]ImageOption{nil, {IgnoreRockRidge()}, {IgnoreRockRidge(), IgnoreJoliet()}} {
+		image, err := OpenImage(bytes.NewReader(buf.Bytes()), opts...)
+		assert.NoError(t, err)
+
+		entries, err := image.ReadDir("data")
+		assert.NoError(t, err)
+		assert.Len(t, entries, 3)
+
+		f, err := image.Lookup("data/large.bin")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Len(t, f.sections, 3)
+		for n, section := range f.sections {
+			assert.Equal(t, n < 2, section.FileFlags&dirFlagMultiExtent != 0)
+		}
+		assert.Equal(t, int64(len(content)), f.Size())
+		data, err := ioutil.ReadAll(f.Reader())
+		assert.NoError(t, err)
+		assert.Equal(t, content, data)
+
+		// reads across sections
+		part := make([]byte, 2*sectorSize)
+		_, err = f.sectionReader().ReadAt(part, 3*int64(sectorSize))
+		assert.NoError(t, err)
+		assert.Equal(t, content[3*sectorSize:5*sectorSize], part)
+
+		f, err = image.Lookup("data/single.bin")
+		if assert.NoError(t, err) {
+			assert.Nil(t, f.sections)
+			assert.Equal(t, int64(4*sectorSize), f.Size())
+		}
+
+		data, err = image.ReadFile("data/zzz.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "after", string(data))
+	}
+}
+
+func TestWriterBeyond4GB(t *testing.T) {
+	// the contents are never read, only the directories placed after them
+	big := NewItemFunc(5<<30, func() (io.ReadCloser, error) {
+		return nil, errors.New("unexpected read")
+	})
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddFile(big, "big.bin"))
+	assert.NoError(t, w.AddFile(strings.NewReader("small"), "z/small.txt"))
+
+	img, err := w.Finalize()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer img.Close()
+
+	image, err := OpenImage(img)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dir, err := image.Lookup("z")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, dataOffset(dir.de) > 4<<30)
+	children, err := dir.GetChildren()
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+
+	data, err := image.ReadFile("z/small.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "small", string(data))
+}
+
+func TestWriterRepeatedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iso9660_repeat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "local.txt"), bytes.Repeat([]byte("local "), 3000), 0644))
+
+	w := newVirtualTestWriter(t, dir)
+	first := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(first))
+
+	// the same writer produces the same image again, including concurrently
+	images := make([]*bytes.Buffer, 4)
+	var wg sync.WaitGroup
+	for n := range images {
+		images[n] = &bytes.Buffer{}
+		wg.Add(1)
+		go func(buf *bytes.Buffer) {
+			defer wg.Done()
+			assert.NoError(t, w.WriteTo(buf))
+		}(images[n])
+	}
+	wg.Wait()
+	for _, buf := range images {
+		assert.True(t, bytes.Equal(first.Bytes(), buf.Bytes()))
+	}
+
+	// writing did not alter the staged tree
+	assert.Equal(t, int32(0), w.Primary.VolumeSpaceSize)
+	assert.NoError(t, w.AddFile(strings.NewReader("more"), "more.txt"))
+	data, image := writeTestImage(t, w)
+	if image != nil {
+		assert.False(t, bytes.Equal(first.Bytes(), data))
+		for _, name := range []string{"hello.txt", "more.txt", "dir/local.txt"} {
+			_, err := image.Lookup(name)
+			assert.NoError(t, err, name)
+		}
+	}
+}
+
+func TestWriterCustomItems(t *testing.T) {
+	content := bytes.Repeat([]byte("generated "), 100000)
+	opened := 0
+	generated := NewItemFunc(int64(len(content)), func() (io.ReadCloser, error) {
+		opened++
+		// hide the io.ReaderAt of bytes.Reader, as a stream
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(content))), nil
+	})
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddFile(generated, "generated.txt"))
+	assert.NoError(t, w.AddFile(NewItemReaderAt(strings.NewReader("readerat and more"), 8), "readerat.txt"))
+
+	for i := 0; i < 2; i++ {
+		_, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		for name, expected := range map[string][]byte{"generated.txt": content, "readerat.txt": []byte("readerat")} {
+			f, err := image.Lookup(name)
+			if assert.NoError(t, err, name) {
+				data, err := ioutil.ReadAll(f.Reader())
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(expected, data), name)
+			}
+		}
+	}
+	assert.Equal(t, 2, opened)
+
+	// streams are opened again to read backwards
+	img, err := w.Finalize()
+	if assert.NoError(t, err) {
+		defer img.Close()
+		image, err := OpenImage(img)
+		assert.NoError(t, err)
+		f, err := image.Lookup("generated.txt")
+		if assert.NoError(t, err) {
+			start := int64(f.de.ExtentLocation) * int64(sectorSize)
+			buf := make([]byte, 10)
+			for _, off := range []int64{500000, 10} {
+				_, err = img.ReadAt(buf, start+off)
+				assert.NoError(t, err)
+				assert.Equal(t, content[off:off+10], buf)
+			}
+		}
+	}
+
+	// the contents must be as large as announced
+	w, err = NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddFile(NewItemFunc(5000, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("short")), nil
+	}), "short.txt"))
+	assert.Error(t, w.WriteTo(&bytes.Buffer{}))
+}
+
+func TestWriterReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iso9660_reproducible")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local.txt")
+	assert.NoError(t, ioutil.WriteFile(local, bytes.Repeat([]byte("local "), 3000), 0644))
+
+	date := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	os.Setenv("SOURCE_DATE_EPOCH", strconv.FormatInt(date.Unix(), 10))
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	var images [][]byte
+	for n, mtime := range []time.Time{date.Add(time.Hour), date.Add(48 * time.Hour)} {
+		// local files changed after the source date, on different hosts
+		assert.NoError(t, os.Chtimes(local, mtime, mtime))
+		w := newVirtualTestWriter(t, dir)
+		w.Reproducible = true
+		w.GPT = &GPT{}
+		now := VolumeDescriptorTimestampFromTime(time.Now().Add(time.Duration(n) * time.Hour))
+		w.Primary.VolumeCreationDateAndTime = now
+		w.Primary.VolumeModificationDateAndTime = now
+		w.Primary.VolumeEffectiveDateAndTime = now
+		assert.NoError(t, w.SetAttributes("hello.txt", Attributes{Mode: 0600, ModTime: date.Add(-time.Hour).In(time.FixedZone("", 3600*n))}))
+		fat := NewFATImage()
+		assert.True(t, date.Equal(fat.ModTime))
+		assert.NoError(t, fat.AddFile(strings.NewReader("efi"), "EFI/BOOT/BOOTX64.EFI"))
+		esp, err := fat.Item()
+		assert.NoError(t, err)
+		assert.NoError(t, w.AppendPartition(esp, mbrPartitionEFI))
+
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		images = append(images, data)
+
+		pvd := image.primaryVolume()
+		assert.True(t, date.Equal(pvd.VolumeCreationDateAndTime.Time()))
+		assert.Equal(t, "", strings.TrimSpace(pvd.SystemIdentifier))
+		for name, expected := range map[string]time.Time{"dir/local.txt": date, "hello.txt": date.Add(-time.Hour), "dir/numbers.txt": date} {
+			f, err := image.Lookup(name)
+			if assert.NoError(t, err, name) {
+				assert.True(t, expected.Equal(f.ModTime()), name)
+				assert.True(t, expected.Equal(time.Time(f.de.RecordingDateTime)), name)
+			}
+		}
+	}
+	if len(images) == 2 {
+		assert.True(t, bytes.Equal(images[0], images[1]))
+	}
+
+	// an explicit date takes precedence
+	w := newVirtualTestWriter(t, dir)
+	w.Reproducible = true
+	w.SourceDate = date.Add(time.Hour)
+	_, image := writeTestImage(t, w)
+	if image != nil {
+		assert.True(t, date.Add(time.Hour).Equal(image.primaryVolume().VolumeCreationDateAndTime.Time()))
+	}
+
+	// the disk GUID depends on the names of files
+	var guids [][]byte
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w := newVirtualTestWriter(t, dir)
+		w.Reproducible = true
+		w.GPT = &GPT{}
+		assert.NoError(t, w.AddFile(strings.NewReader("extra"), name))
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		guids = append(guids, data[512+56:512+72])
+	}
+	assert.NotEqual(t, guids[0], guids[1])
+
+	os.Setenv("SOURCE_DATE_EPOCH", "soon")
+	w = newVirtualTestWriter(t, dir)
+	w.Reproducible = true
+	assert.Error(t, w.WriteTo(&bytes.Buffer{}))
+}
+
+func TestWriterRecordAttributes(t *testing.T) {
+	defer func(length uint32) { maxExtentLength = length }(maxExtentLength)
+	maxExtentLength = 4 * sectorSize
+
+	large := make([]byte, 10*sectorSize+100)
+	for i := range large {
+		large[i] = byte(i / 7)
+	}
+	mtime := time.Date(2019, 8, 7, 6, 5, 4, 0, time.UTC)
+	ear := &ExtendedAttributeRecord{
+		OwnerIdentification:         1000,
+		GroupIdentification:         100,
+		Permissions:                 0x0400, // other class may not read
+		FileModificationDateAndTime: VolumeDescriptorTimestampFromTime(mtime),
+		RecordFormat:                1,
+		RecordLength:                80,
+		SystemIdentifier:            "TEST",
+		ApplicationUse:              bytes.Repeat([]byte{0xa5}, 3000),
+	}
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	assert.NoError(t, w.AddFile(strings.NewReader("with ear"), "ear.txt"))
+	assert.NoError(t, w.AddFile(bytes.NewReader(large), "large.bin"))
+	assert.NoError(t, w.AddFile(strings.NewReader("hidden"), "dir/hidden.txt"))
+	assert.NoError(t, w.AddFile(strings.NewReader("associated"), "dir/assoc.txt"))
+	assert.NoError(t, w.SetAttributes("ear.txt", Attributes{Mode: 0644, ModTime: mtime}))
+	assert.NoError(t, w.SetExtendedAttributes("ear.txt", ear))
+	assert.NoError(t, w.SetExtendedAttributes("large.bin", &ExtendedAttributeRecord{}))
+	assert.NoError(t, w.SetAttributes("dir", Attributes{Mode: os.ModeDir | 0750, ModTime: mtime}))
+	assert.NoError(t, w.SetHidden("dir", true))
+	assert.NoError(t, w.SetHidden("dir/hidden.txt", true))
+	assert.NoError(t, w.SetAssociated("dir/assoc.txt", true))
+	assert.NoError(t, w.SetHidden("dir/assoc.txt", true))
+	assert.NoError(t, w.SetHidden("dir/assoc.txt", false))
+	assert.Equal(t, ErrDirectoryEAR, w.SetExtendedAttributes("dir", ear))
+	assert.Equal(t, os.ErrNotExist, w.SetHidden("missing", true))
+
+	_, image := writeTestImage(t, w)
+	if image == nil {
+		return
+	}
+	for name, expected := range map[string][]byte{"ear.txt": []byte("with ear"), "large.bin": large, "dir/hidden.txt": []byte("hidden")} {
+		f, err := image.Lookup(name)
+		if assert.NoError(t, err, name) {
+			data, err := ioutil.ReadAll(f.Reader())
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(expected, data), name)
+		}
+	}
+
+	f, err := image.Lookup("ear.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, byte(2), f.de.ExtendedAtributeRecordLength)
+		assert.Equal(t, byte(dirFlagRecord|dirFlagProtection), f.de.FileFlags)
+		assert.True(t, mtime.Equal(f.ModTime()))
+		res, err := f.ExtendedAttributes()
+		if assert.NoError(t, err) {
+			expected := *ear
+			expected.Permissions |= earPermissionsReserved
+			assert.Equal(t, &expected, res)
+		}
+	}
+
+	// only the first section of a multi-extent file has an EAR
+	f, err = image.Lookup("large.bin")
+	if assert.NoError(t, err) {
+		assert.Len(t, f.sections, 3)
+		assert.Equal(t, byte(1), f.sections[0].ExtendedAtributeRecordLength)
+		assert.Equal(t, byte(0), f.sections[1].ExtendedAtributeRecordLength)
+		assert.Equal(t, f.sections[0].ExtentLocation+5, f.sections[1].ExtentLocation)
+	}
+
+	for name, flags := range map[string]byte{"dir": dirFlagDir | dirFlagHidden, "dir/hidden.txt": dirFlagHidden, "dir/assoc.txt": dirFlagAssociated} {
+		f, err := image.Lookup(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, flags, f.de.FileFlags, name)
+			ear, err := f.ExtendedAttributes()
+			assert.NoError(t, err)
+			assert.Nil(t, ear)
+		}
+	}
+
+	// setting the flags kept the POSIX attributes
+	f, err = image.Lookup("dir")
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.ModeDir|0750, f.Mode())
+		assert.True(t, mtime.Equal(f.ModTime()))
+	}
+}
+
+func TestWriterNameCollisions(t *testing.T) {
+	files := []string{"foo.bar.txt", "foo_bar.txt", "FOO_BAR.TXT", "a.b/file", "a_b/file", "ThisFileNameIsFarTooLongToBeKept1.txt", "ThisFileNameIsFarTooLongToBeKept2.txt"}
+	newWriter := func(policy CollisionPolicy, reverse bool) *ImageWriter {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.Reproducible = true
+		w.Collisions = policy
+		for i := range files {
+			name := files[i]
+			if reverse {
+				name = files[len(files)-1-i]
+			}
+			assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+		}
+		return w
+	}
+
+	w := newWriter(CollisionFail, false)
+	assert.True(t, errors.Is(w.WriteTo(&bytes.Buffer{}), ErrNameCollision))
+	_, err := w.MangledPath("foo_bar.txt")
+	assert.True(t, errors.Is(err, ErrNameCollision))
+
+	// paths follow the changes of the writer
+	w.Collisions = CollisionNumeric
+	id, err := w.MangledPath("foo.bar.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "FOO_BAR~01.TXT;1", id)
+	w.InterchangeLevel = 1
+	id, err = w.MangledPath("foo.bar.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "FOO_B~01.TXT;1", id)
+	_, err = w.MangledPath("new.txt")
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.NoError(t, w.AddFile(strings.NewReader("new"), "new.txt"))
+	id, err = w.MangledPath("new.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "NEW.TXT;1", id)
+
+	for policy, expected := range map[CollisionPolicy]map[string]string{
+		CollisionNumeric: {
+			"FOO_BAR.TXT":                           "FOO_BAR.TXT;1",
+			"foo.bar.txt":                           "FOO_BAR~01.TXT;1",
+			"foo_bar.txt":                           "FOO_BAR~02.TXT;1",
+			"a.b/file":                              "A_B/FILE;1",
+			"a_b/file":                              "A_B~01/FILE;1",
+			"ThisFileNameIsFarTooLongToBeKept1.txt": "THISFILENAMEISFARTOOLONG.TXT;1",
+			"ThisFileNameIsFarTooLongToBeKept2.txt": "THISFILENAMEISFARTOOL~01.TXT;1",
+		},
+		CollisionHash: nil,
+	} {
+		var images [][]byte
+		for _, reverse := range []bool{false, true} {
+			w := newWriter(policy, reverse)
+			data, image := writeTestImage(t, w)
+			if image == nil {
+				return
+			}
+			images = append(images, data)
+
+			ids := make(map[string]bool)
+			for _, name := range files {
+				id, err := w.MangledPath(name)
+				assert.NoError(t, err)
+				if expected != nil {
+					assert.Equal(t, expected[name], id, name)
+				}
+				ids[id] = true
+
+				f, err := image.Lookup(strings.Replace(id, ";1", "", 1))
+				if assert.NoError(t, err, id) {
+					data, err := ioutil.ReadAll(f.Reader())
+					assert.NoError(t, err)
+					assert.Equal(t, name, string(data))
+				}
+			}
+			assert.Len(t, ids, len(files))
+		}
+		if len(images) == 2 {
+			assert.True(t, bytes.Equal(images[0], images[1]))
+		}
+	}
+
+	_, err = newWriter(CollisionNumeric, false).MangledPath("missing.txt")
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestWriterInterchangeLevels(t *testing.T) {
+	defer func(length uint32) { maxExtentLength = length }(maxExtentLength)
+	maxExtentLength = 4 * sectorSize
+
+	files := []string{"long_filename.text", "directory_name/file", ".config/.bashrc", "foo.bar.txt", "foo_bar.txt", "ThisFileNameIsFarTooLongToBeKeptHere.txt"}
+	for _, testcase := range []struct {
+		level    int
+		relax    Relaxations
+		expected []string
+	}{
+		{1, Relaxations{}, []string{"LONG_FIL.TEX;1", "DIRECTOR/FILE;1", "_CONFIG/.BAS;1", "FOO_BAR.TXT;1", "FOO_B~01.TXT;1", "THISFILE.TXT;1"}},
+		{2, Relaxations{}, []string{"LONG_FILENAME.TEXT;1", "DIRECTORY_NAME/FILE;1", "_CONFIG/.BASHRC;1", "FOO_BAR.TXT;1", "FOO_BAR~01.TXT;1", "THISFILENAMEISFARTOOLONG.TXT;1"}},
+		{0, Relaxations{AllowLowercase: true, OmitVersion: true}, []string{"long_filename.text", "directory_name/file", "_config/.bashrc", "foo_bar.txt", "foo_bar~01.txt", "ThisFileNameIsFarTooLongTo.txt"}},
+		{3, Relaxations{LongNames: true, AllowLeadingDots: true}, []string{"LONG_FILENAME.TEXT", "DIRECTORY_NAME/FILE", ".CONFIG/.BASHRC", "FOO_BAR.TXT", "FOO_BAR~01.TXT", "THISFILENAMEISFARTOOLONGTOBEKEPTH.TXT"}},
+		{1, Relaxations{AllowLeadingDots: true}, []string{"LONG_FIL.TEX;1", "DIRECTOR/FILE;1", ".CONFIG/.BASHRC;1", "FOO_BAR.TXT;1", "FOO_B~01.TXT;1", "THISFILE.TXT;1"}},
+	} {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.InterchangeLevel = testcase.level
+		w.Relaxations = testcase.relax
+		w.Collisions = CollisionNumeric
+		for _, name := range files {
+			assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+		}
+
+		_, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		for n, name := range files {
+			id, err := w.MangledPath(name)
+			assert.NoError(t, err)
+			assert.Equal(t, testcase.expected[n], id)
+
+			f, err := image.Lookup(strings.Replace(id, ";1", "", 1))
+			if assert.NoError(t, err, id) {
+				data, err := ioutil.ReadAll(f.Reader())
+				assert.NoError(t, err)
+				assert.Equal(t, name, string(data))
+			}
+		}
+	}
+
+	// files larger than an extent need level 3
+	for _, level := range []int{1, 2, 3, 4} {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.InterchangeLevel = level
+		assert.NoError(t, w.AddFile(bytes.NewReader(make([]byte, 5*sectorSize)), "large.bin"))
+		err = w.WriteTo(&bytes.Buffer{})
+		switch level {
+		case 1, 2:
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), ErrFileTooLarge.Error())
+			}
+		case 3:
+			assert.NoError(t, err)
+		default:
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestWriterPathLimits(t *testing.T) {
+	deep := "1/2/3/4/5/6/7/8/file"
+
+	// non-conforming images are still allowed by default
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddFile(strings.NewReader("deep"), deep))
+	assert.NoError(t, w.WriteTo(&bytes.Buffer{}))
+
+	// and rejected at write time in strict mode
+	w.Strict = true
+	assert.True(t, errors.Is(w.WriteTo(&bytes.Buffer{}), ErrPathTooDeep))
+
+	w, err = NewWriter()
+	assert.NoError(t, err)
+	w.Strict = true
+	assert.NoError(t, w.AddFile(strings.NewReader("ok"), "1/2/3/4/5/6/7/file"))
+	assert.NoError(t, w.AddDirectory("1/2/3/4/5/6/7"))
+	assert.True(t, errors.Is(w.AddFile(strings.NewReader("deep"), deep), ErrPathTooDeep))
+	assert.True(t, errors.Is(w.AddDirectory("1/2/3/4/5/6/7/8"), ErrPathTooDeep))
+
+	// path length is checked once names are mangled
+	long := strings.Repeat("a", 40)
+	longPath := strings.Repeat(long+"/", 7) + long
+	assert.NoError(t, w.AddFile(strings.NewReader("long"), longPath))
+	w.Relaxations.LongNames = true
+	assert.True(t, errors.Is(w.AddFile(strings.NewReader("long"), longPath+"2"), ErrPathTooLong))
+	assert.True(t, errors.Is(w.WriteTo(&bytes.Buffer{}), ErrPathTooLong))
+
+	w.Relaxations.LongNames = false
+	assert.NoError(t, w.WriteTo(&bytes.Buffer{}))
+}
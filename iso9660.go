@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -88,10 +89,15 @@ var _ encoding.BinaryUnmarshaler = &BootVolumeDescriptorBody{}
 
 // PrimaryVolumeDescriptorBody represents the data in bytes 7-2047
 // of a Primary Volume Descriptor as defined in ECMA-119 8.4
+//
+// It is also used for Supplementary Volume Descriptors (ECMA-119 8.5), in
+// which case VolumeFlags and EscapeSequences may be set.
 type PrimaryVolumeDescriptorBody struct {
+	VolumeFlags                   byte
 	SystemIdentifier              string
 	VolumeIdentifier              string
 	VolumeSpaceSize               int32
+	EscapeSequences               [32]byte
 	VolumeSetSize                 int16
 	VolumeSequenceNumber          int16
 	LogicalBlockSize              int16
@@ -173,7 +179,8 @@ func (de *DirectoryEntry) UnmarshalBinary(data []byte) error {
 
 	// add padding if identifier length was even]
 	idPaddingLen := (identifierLen + 1) % 2
-	de.SystemUse = data[33+identifierLen+idPaddingLen : length]
+	// copy system use so it doesn't alias the caller's buffer
+	de.SystemUse = append([]byte(nil), data[33+identifierLen+idPaddingLen:length]...)
 
 	return nil
 }
@@ -224,6 +231,106 @@ func (de *DirectoryEntry) Clone() DirectoryEntry {
 	return newDE
 }
 
+// ExtendedAttributeRecord contains data from an Extended Attribute Record as
+// described by ECMA-119 9.5, recorded in the first blocks of a file's extent
+type ExtendedAttributeRecord struct {
+	OwnerIdentification uint16
+	GroupIdentification uint16
+	// Permissions are the permission bits of ECMA-119 9.5.3, a bit set
+	// denying the access. Reserved odd bits are always set when written.
+	Permissions                 uint16
+	FileCreationDateAndTime     VolumeDescriptorTimestamp
+	FileModificationDateAndTime VolumeDescriptorTimestamp
+	FileExpirationDateAndTime   VolumeDescriptorTimestamp
+	FileEffectiveDateAndTime    VolumeDescriptorTimestamp
+	RecordFormat                byte
+	RecordAttributes            byte
+	RecordLength                uint16
+	SystemIdentifier            string
+	SystemUse                   [64]byte
+	ApplicationUse              []byte
+	EscapeSequences             []byte
+}
+
+// earPermissionsReserved are the bits of the permissions of an Extended
+// Attribute Record which are always set
+const earPermissionsReserved = 0xaaaa
+
+var _ encoding.BinaryUnmarshaler = &ExtendedAttributeRecord{}
+var _ encoding.BinaryMarshaler = &ExtendedAttributeRecord{}
+
+// UnmarshalBinary decodes an ExtendedAttributeRecord from binary form
+func (ear *ExtendedAttributeRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 250 {
+		return io.ErrUnexpectedEOF
+	}
+
+	ear.OwnerIdentification = binary.BigEndian.Uint16(data[2:4])
+	ear.GroupIdentification = binary.BigEndian.Uint16(data[6:8])
+	ear.Permissions = binary.BigEndian.Uint16(data[8:10])
+
+	for i, ts := range []*VolumeDescriptorTimestamp{&ear.FileCreationDateAndTime, &ear.FileModificationDateAndTime, &ear.FileExpirationDateAndTime, &ear.FileEffectiveDateAndTime} {
+		if err := ts.UnmarshalBinary(data[10+i*17 : 27+i*17]); err != nil {
+			return err
+		}
+	}
+
+	ear.RecordFormat = data[78]
+	ear.RecordAttributes = data[79]
+	ear.RecordLength = binary.BigEndian.Uint16(data[82:84])
+	ear.SystemIdentifier = strings.TrimRight(string(data[84:116]), " ")
+	copy(ear.SystemUse[:], data[116:180])
+	if data[180] != 1 {
+		return fmt.Errorf("unsupported extended attribute record version %d", data[180])
+	}
+
+	escLen := int(data[181])
+	auLen := int(binary.BigEndian.Uint16(data[248:250]))
+	if len(data) < 250+auLen+escLen {
+		return io.ErrUnexpectedEOF
+	}
+	ear.ApplicationUse = append([]byte(nil), data[250:250+auLen]...)
+	ear.EscapeSequences = append([]byte(nil), data[250+auLen:250+auLen+escLen]...)
+
+	return nil
+}
+
+// MarshalBinary encodes an ExtendedAttributeRecord to binary form
+func (ear *ExtendedAttributeRecord) MarshalBinary() ([]byte, error) {
+	if len(ear.EscapeSequences) > 255 {
+		return nil, errors.New("extended attribute record escape sequences are too long")
+	}
+	if len(ear.ApplicationUse) > math.MaxInt16 {
+		return nil, errors.New("extended attribute record application use is too long")
+	}
+
+	data := make([]byte, 250+len(ear.ApplicationUse)+len(ear.EscapeSequences))
+	WriteInt16LSBMSB(data[0:4], int16(ear.OwnerIdentification))
+	WriteInt16LSBMSB(data[4:8], int16(ear.GroupIdentification))
+	binary.BigEndian.PutUint16(data[8:10], ear.Permissions|earPermissionsReserved)
+
+	for i, ts := range []*VolumeDescriptorTimestamp{&ear.FileCreationDateAndTime, &ear.FileModificationDateAndTime, &ear.FileExpirationDateAndTime, &ear.FileEffectiveDateAndTime} {
+		d, err := ts.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		copy(data[10+i*17:27+i*17], d)
+	}
+
+	data[78] = ear.RecordFormat
+	data[79] = ear.RecordAttributes
+	WriteInt16LSBMSB(data[80:84], int16(ear.RecordLength))
+	copy(data[84:116], MarshalString(ear.SystemIdentifier, 32))
+	copy(data[116:180], ear.SystemUse[:])
+	data[180] = 1 // version
+	data[181] = byte(len(ear.EscapeSequences))
+	WriteInt16LSBMSB(data[246:250], int16(len(ear.ApplicationUse)))
+	copy(data[250:], ear.ApplicationUse)
+	copy(data[250+len(ear.ApplicationUse):], ear.EscapeSequences)
+
+	return data, nil
+}
+
 // UnmarshalBinary decodes a PrimaryVolumeDescriptorBody from binary form as defined in ECMA-119 8.4
 func (pvd *PrimaryVolumeDescriptorBody) UnmarshalBinary(data []byte) error {
 	if len(data) < 2048 {
@@ -232,6 +339,7 @@ func (pvd *PrimaryVolumeDescriptorBody) UnmarshalBinary(data []byte) error {
 
 	var err error
 
+	pvd.VolumeFlags = data[7]
 	pvd.SystemIdentifier = strings.TrimRight(string(data[8:40]), " ")
 	pvd.VolumeIdentifier = strings.TrimRight(string(data[40:72]), " ")
 
@@ -239,6 +347,8 @@ func (pvd *PrimaryVolumeDescriptorBody) UnmarshalBinary(data []byte) error {
 		return err
 	}
 
+	copy(pvd.EscapeSequences[:], data[88:120])
+
 	if pvd.VolumeSetSize, err = UnmarshalInt16LSBMSB(data[120:124]); err != nil {
 		return err
 	}
@@ -301,6 +411,8 @@ func (pvd *PrimaryVolumeDescriptorBody) UnmarshalBinary(data []byte) error {
 func (pvd PrimaryVolumeDescriptorBody) MarshalBinary() ([]byte, error) {
 	output := make([]byte, sectorSize)
 
+	output[7] = pvd.VolumeFlags
+
 	d := MarshalString(pvd.SystemIdentifier, 32)
 	copy(output[8:40], d)
 
@@ -308,6 +420,7 @@ func (pvd PrimaryVolumeDescriptorBody) MarshalBinary() ([]byte, error) {
 	copy(output[40:72], d)
 
 	WriteInt32LSBMSB(output[80:88], pvd.VolumeSpaceSize)
+	copy(output[88:120], pvd.EscapeSequences[:])
 	WriteInt16LSBMSB(output[120:124], pvd.VolumeSetSize)
 	WriteInt16LSBMSB(output[124:128], pvd.VolumeSequenceNumber)
 	WriteInt16LSBMSB(output[128:132], pvd.LogicalBlockSize)
@@ -541,6 +654,13 @@ func (ts *VolumeDescriptorTimestamp) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// Time returns the timestamp as a time.Time
+func (ts VolumeDescriptorTimestamp) Time() time.Time {
+	secondsInAQuarter := 60 * 15
+	tz := time.FixedZone("", int(int8(ts.Offset))*secondsInAQuarter)
+	return time.Date(ts.Year, time.Month(ts.Month), ts.Day, ts.Hour, ts.Minute, ts.Second, ts.Hundredth*10000000, tz)
+}
+
 // RecordingTimestamp represents a time and date format
 // that can be encoded according to ECMA-119 9.1.5
 type RecordingTimestamp time.Time
@@ -559,7 +679,7 @@ func (ts *RecordingTimestamp) UnmarshalBinary(data []byte) error {
 	hour := int(data[3])
 	min := int(data[4])
 	sec := int(data[5])
-	tzOffset := int(data[6])
+	tzOffset := int(int8(data[6]))
 	secondsInAQuarter := 60 * 15
 
 	tz := time.FixedZone("", tzOffset*secondsInAQuarter)
@@ -3,7 +3,9 @@ package iso9660
 import (
 	"bytes"
 	"io"
+	"io/fs"
 	"os"
+	"sync"
 )
 
 type Item interface {
@@ -14,6 +16,22 @@ type Item interface {
 	// private
 	sectors() uint32
 	meta() *itemMeta
+	open() (itemFile, error)
+}
+
+// itemFile is an opened Item, whose contents can be read at any offset
+type itemFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// nopCloserFile is an itemFile with nothing to close
+type nopCloserFile struct {
+	io.ReaderAt
+}
+
+func (nopCloserFile) Close() error {
+	return nil
 }
 
 func NewItemReader(r io.Reader) (Item, error) {
@@ -46,6 +64,49 @@ func bufferizeItem(r io.Reader) (Item, error) {
 	return &bufferHndlr{d: buf.Bytes()}, nil
 }
 
+// peekItem returns the first n bytes of item, or less if it is shorter,
+// along with the item to use in its place, as items that can only be read
+// once get buffered.
+func peekItem(item Item, n int) ([]byte, Item, error) {
+	buf := make([]byte, n)
+	var (
+		m   int
+		err error
+	)
+
+	switch v := item.(type) {
+	case *bufferHndlr:
+		return buf[:copy(buf, v.d)], item, nil
+	case *readerHndlr:
+		m, err = v.ReadAt(buf, v.Reader.Size()-int64(v.Len()))
+	case *filepathHndlr:
+		var f *os.File
+		if f, err = os.Open(v.path); err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		m, err = io.ReadFull(f, buf)
+	case *fsHndlr:
+		var f fs.File
+		if f, err = v.fsys.Open(v.name); err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		m, err = io.ReadFull(f, buf)
+	default:
+		res, err := bufferizeItem(item)
+		if err != nil {
+			return nil, nil, err
+		}
+		return buf[:copy(buf, res.(*bufferHndlr).d)], res, nil
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:m], item, err
+}
+
 func NewItemFile(filename string) (Item, error) {
 	st, err := os.Stat(filename)
 	if err != nil {
@@ -58,6 +119,20 @@ func NewItemFile(filename string) (Item, error) {
 	return &filepathHndlr{path: filename, st: st}, nil
 }
 
+// NewItemFS returns an Item for the named file of fsys. The file is only
+// opened when the image is written.
+func NewItemFS(fsys fs.FS, name string) (Item, error) {
+	st, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	if st.IsDir() {
+		return nil, ErrIsDir
+	}
+
+	return &fsHndlr{fsys: fsys, name: name, size: st.Size()}, nil
+}
+
 // fileHndlr: handles an existing open file
 type fileHndlr struct {
 	*os.File
@@ -91,6 +166,11 @@ func (f *fileHndlr) meta() *itemMeta {
 	return &f.m
 }
 
+func (f *fileHndlr) open() (itemFile, error) {
+	// not our file, so not closing it
+	return nopCloserFile{f.File}, nil
+}
+
 // readerHndlr: handles a bytes.Reader
 type readerHndlr struct {
 	*bytes.Reader
@@ -117,6 +197,11 @@ func (b *readerHndlr) meta() *itemMeta {
 	return &b.m
 }
 
+func (b *readerHndlr) open() (itemFile, error) {
+	start := b.Reader.Size() - int64(b.Reader.Len())
+	return nopCloserFile{io.NewSectionReader(b.Reader, start, b.Size())}, nil
+}
+
 // bufferHndlr: handle a []byte array
 type bufferHndlr struct {
 	d []byte
@@ -154,6 +239,10 @@ func (b *bufferHndlr) meta() *itemMeta {
 	return &b.m
 }
 
+func (b *bufferHndlr) open() (itemFile, error) {
+	return nopCloserFile{bytes.NewReader(b.d)}, nil
+}
+
 // filepathHandlr: handle a file by path
 type filepathHndlr struct {
 	path string
@@ -198,6 +287,245 @@ func (f *filepathHndlr) meta() *itemMeta {
 	return &f.m
 }
 
+func (f *filepathHndlr) open() (itemFile, error) {
+	return os.Open(f.path)
+}
+
+// fsHndlr: handle a file from a fs.FS, opened when read
+type fsHndlr struct {
+	fsys fs.FS
+	name string
+	size int64
+	f    fs.File
+	m    itemMeta
+}
+
+func (f *fsHndlr) Read(p []byte) (int, error) {
+	if f.f == nil {
+		var err error
+		f.f, err = f.fsys.Open(f.name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return f.f.Read(p)
+}
+
+func (f *fsHndlr) Size() int64 {
+	return f.size
+}
+
+func (f *fsHndlr) sectors() uint32 {
+	siz := f.Size()
+	if siz%int64(sectorSize) == 0 {
+		return uint32(siz / int64(sectorSize))
+	}
+	return uint32(siz/int64(sectorSize)) + 1
+}
+
+func (f *fsHndlr) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.f.Close()
+	f.f = nil
+	return err
+}
+
+func (f *fsHndlr) meta() *itemMeta {
+	return &f.m
+}
+
+func (f *fsHndlr) open() (itemFile, error) {
+	return openReaderAt(func() (io.ReadCloser, error) {
+		return f.fsys.Open(f.name)
+	})
+}
+
+// openReaderAt opens a stream, which can then be read at any offset
+func openReaderAt(open func() (io.ReadCloser, error)) (itemFile, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := rc.(itemFile); ok {
+		return ra, nil
+	}
+	return &streamReaderAt{open: open, f: rc}, nil
+}
+
+// streamReaderAt reads a stream that can't be read at any offset, by
+// seeking or opening it again from the start
+type streamReaderAt struct {
+	open func() (io.ReadCloser, error)
+	f    io.ReadCloser
+	pos  int64
+	mu   sync.Mutex
+}
+
+func (r *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off != r.pos {
+		if s, ok := r.f.(io.Seeker); ok {
+			if _, err := s.Seek(off, io.SeekStart); err != nil {
+				return 0, err
+			}
+		} else {
+			if off < r.pos {
+				r.f.Close()
+				f, err := r.open()
+				if err != nil {
+					return 0, err
+				}
+				r.f, r.pos = f, 0
+			}
+			if _, err := io.CopyN(io.Discard, r.f, off-r.pos); err != nil {
+				return 0, err
+			}
+		}
+		r.pos = off
+	}
+
+	n, err := io.ReadFull(r.f, p)
+	r.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *streamReaderAt) Close() error {
+	return r.f.Close()
+}
+
+// NewItemFunc returns an Item of the given size, whose contents are read
+// from the stream returned by open when the image is written. open may be
+// called several times, as each write of the image reads the contents
+// again, and must return the same data each time. This allows streaming
+// large contents, such as blobs from a remote storage or the output of a
+// decompressor, without buffering them.
+func NewItemFunc(size int64, open func() (io.ReadCloser, error)) Item {
+	return &funcHndlr{size: size, openFunc: open}
+}
+
+// funcHndlr: handle contents returned by a function, opened when read
+type funcHndlr struct {
+	size     int64
+	openFunc func() (io.ReadCloser, error)
+	rc       io.ReadCloser
+	pos      int64
+	m        itemMeta
+}
+
+func (f *funcHndlr) Read(p []byte) (int, error) {
+	if f.rc == nil {
+		var err error
+		f.rc, err = f.openFunc()
+		if err != nil {
+			return 0, err
+		}
+		f.pos = 0
+	}
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.size-f.pos {
+		p = p[:f.size-f.pos]
+	}
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	if err == io.EOF && f.pos < f.size {
+		// the contents must be as large as announced
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *funcHndlr) Size() int64 {
+	return f.size
+}
+
+func (f *funcHndlr) sectors() uint32 {
+	siz := f.Size()
+	if siz%int64(sectorSize) == 0 {
+		return uint32(siz / int64(sectorSize))
+	}
+	return uint32(siz/int64(sectorSize)) + 1
+}
+
+func (f *funcHndlr) Close() error {
+	if f.rc == nil {
+		return nil
+	}
+	err := f.rc.Close()
+	f.rc = nil
+	return err
+}
+
+func (f *funcHndlr) meta() *itemMeta {
+	return &f.m
+}
+
+func (f *funcHndlr) open() (itemFile, error) {
+	return openReaderAt(f.openFunc)
+}
+
+// NewItemReaderAt returns an Item for the first size bytes of r, which are
+// read when the image is written. r may be read concurrently when writing
+// the image several times at once.
+func NewItemReaderAt(r io.ReaderAt, size int64) Item {
+	return &readerAtHndlr{ra: r, size: size}
+}
+
+// readerAtHndlr: handle a io.ReaderAt of a known size
+type readerAtHndlr struct {
+	ra   io.ReaderAt
+	size int64
+	r    *io.SectionReader
+	m    itemMeta
+}
+
+func (r *readerAtHndlr) Read(p []byte) (int, error) {
+	if r.r == nil {
+		r.r = io.NewSectionReader(r.ra, 0, r.size)
+	}
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		if pos, _ := r.r.Seek(0, io.SeekCurrent); pos < r.size {
+			// the contents must be as large as announced
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *readerAtHndlr) Size() int64 {
+	return r.size
+}
+
+func (r *readerAtHndlr) sectors() uint32 {
+	siz := r.Size()
+	if siz%int64(sectorSize) == 0 {
+		return uint32(siz / int64(sectorSize))
+	}
+	return uint32(siz/int64(sectorSize)) + 1
+}
+
+func (r *readerAtHndlr) Close() error {
+	r.r = nil
+	return nil
+}
+
+func (r *readerAtHndlr) meta() *itemMeta {
+	return &r.m
+}
+
+func (r *readerAtHndlr) open() (itemFile, error) {
+	return nopCloserFile{io.NewSectionReader(r.ra, 0, r.size)}, nil
+}
+
 // NewItemConcat returns a single Item object actually representing multiple
 // items being concatenated.
 func NewItemConcat(items ...Item) Item {
@@ -255,6 +583,65 @@ func (i *itemConcat) meta() *itemMeta {
 	return &i.m
 }
 
+func (i *itemConcat) open() (itemFile, error) {
+	res := &concatFile{}
+	for _, item := range i.items {
+		f, err := item.open()
+		if err != nil {
+			res.Close()
+			return nil, err
+		}
+		res.files = append(res.files, f)
+		res.sizes = append(res.sizes, item.Size())
+	}
+	return res, nil
+}
+
+// concatFile reads the opened items of an itemConcat
+type concatFile struct {
+	files []itemFile
+	sizes []int64
+}
+
+func (c *concatFile) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for i, f := range c.files {
+		if off >= c.sizes[i] {
+			off -= c.sizes[i]
+			continue
+		}
+
+		buf := p[n:]
+		if int64(len(buf)) > c.sizes[i]-off {
+			buf = buf[:c.sizes[i]-off]
+		}
+		m, err := f.ReadAt(buf, off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if m < len(buf) || n == len(p) {
+			break
+		}
+		off = 0
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *concatFile) Close() error {
+	var err error
+	for _, f := range c.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (i *itemConcat) sectors() uint32 {
 	siz := i.Size()
 	if siz%int64(sectorSize) == 0 {
@@ -262,3 +649,34 @@ func (i *itemConcat) sectors() uint32 {
 	}
 	return uint32(siz/int64(sectorSize)) + 1
 }
+
+// itemNode: a zero-length entry such as a symbolic link or a device node,
+// which is only described by its Rock Ridge attributes
+type itemNode struct {
+	target string // symbolic link target
+	m      itemMeta
+}
+
+func (n *itemNode) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (n *itemNode) Size() int64 {
+	return 0
+}
+
+func (n *itemNode) sectors() uint32 {
+	return 0
+}
+
+func (n *itemNode) Close() error {
+	return nil
+}
+
+func (n *itemNode) meta() *itemMeta {
+	return &n.m
+}
+
+func (n *itemNode) open() (itemFile, error) {
+	return nopCloserFile{bytes.NewReader(nil)}, nil
+}
@@ -0,0 +1,160 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Joliet extensions
+// see: https://pismotec.com/cfs/jolspec.html
+
+// escape sequences stored in a supplementary volume descriptor to identify
+// Joliet UCS-2 levels 1, 2 and 3
+var jolietEscapeSequences = [][]byte{
+	{'%', '/', '@'}, // UCS-2 level 1
+	{'%', '/', 'C'}, // UCS-2 level 2
+	{'%', '/', 'E'}, // UCS-2 level 3
+}
+
+// jolietMaxNameLength is the maximum length of a Joliet identifier, in
+// UCS-2 characters, not counting the version part
+const jolietMaxNameLength = 64
+
+// jolietLevel returns the Joliet level (1-3) advertised by the given escape
+// sequences field, or 0 if the volume is not a Joliet volume
+func jolietLevel(esc [32]byte) int {
+	for i, seq := range jolietEscapeSequences {
+		if bytes.Contains(esc[:], seq) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// isJoliet returns true if the volume descriptor is a Joliet supplementary
+// volume descriptor
+func (vd volumeDescriptor) isJoliet() bool {
+	return vd.Type() == volumeTypeSupplementary && vd.Primary != nil && jolietLevel(vd.Primary.EscapeSequences) != 0
+}
+
+// decodeUCS2 decodes a big-endian UCS-2 string as found in Joliet
+// identifiers. Surrogate pairs are accepted even though they are not part of
+// UCS-2 strictly speaking.
+func decodeUCS2(data []byte) string {
+	u := make([]uint16, len(data)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// encodeUCS2 encodes a string as big-endian UCS-2 for use in Joliet
+// identifiers
+func encodeUCS2(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	res := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.BigEndian.PutUint16(res[i*2:], c)
+	}
+	return res
+}
+
+// jolietString encodes s as UCS-2 and pads it with UCS-2 spaces to fill a
+// descriptor field of the given length in bytes
+func jolietString(s string, length int) string {
+	data := encodeUCS2(s)
+	if len(data) > length&^1 {
+		data = data[:length&^1]
+	}
+	for len(data) < length&^1 {
+		data = append(data, 0x00, ' ')
+	}
+	return string(data)
+}
+
+// ucs2Len returns the length of s in UCS-2 characters
+func ucs2Len(s string) int {
+	var l int
+	for _, r := range s {
+		l += len(utf16.Encode([]rune{r}))
+	}
+	return l
+}
+
+// mangleJolietName replaces characters not allowed in Joliet identifiers,
+// and shortens name so that it fits in jolietMaxNameLength once suffix is
+// inserted before its extension.
+func mangleJolietName(name, suffix string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune("*/:;?\\", r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	if suffix == "" && ucs2Len(name) <= jolietMaxNameLength {
+		return name
+	}
+
+	base, ext := name, ""
+	if pos := strings.LastIndexByte(name, '.'); pos > 0 && ucs2Len(name[pos:])+ucs2Len(suffix) < jolietMaxNameLength/2 {
+		base, ext = name[:pos], name[pos:]
+	}
+
+	runes := []rune(base)
+	for len(runes) > 0 && ucs2Len(string(runes))+ucs2Len(suffix)+ucs2Len(ext) > jolietMaxNameLength {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + suffix + ext
+}
+
+// jolietNames computes the Joliet name of each child of dir, indexed by ISO
+// name. Names that collide once shortened (Joliet readers compare names
+// without case) get a numeric suffix. Children are processed in ISO name
+// order so the result does not depend on the order files were added in.
+func jolietNames(dir *itemDir) map[string]string {
+	res := make(map[string]string, len(dir.children))
+	used := make(map[string]bool, len(dir.children))
+
+	for _, isoName := range dir.sortedNames() {
+		name, ok := dir.names[isoName]
+		if !ok {
+			name = isoName
+		}
+
+		candidate := mangleJolietName(name, "")
+		for n := 1; used[strings.ToUpper(candidate)]; n++ {
+			candidate = mangleJolietName(name, "~"+strconv.Itoa(n))
+		}
+		used[strings.ToUpper(candidate)] = true
+		res[isoName] = candidate
+	}
+	return res
+}
+
+// newJolietTree builds the Joliet counterpart of dir. Files are shared with
+// the primary hierarchy so their data is only written once, while directories
+// get their own records with UCS-2 identifiers.
+func newJolietTree(dir *itemDir) *itemDir {
+	res := newDir()
+	res.m.dirPath = dir.m.dirPath
+	res.m.attr = dir.m.attr
+	res.m.flags = dir.m.flags
+
+	for isoName, name := range jolietNames(dir) {
+		c := dir.children[isoName]
+		if sub, ok := c.(*itemDir); ok {
+			id := string(encodeUCS2(name))
+			res.children[id] = newJolietTree(sub)
+			res.names[id] = name
+		} else {
+			id := string(encodeUCS2(name + ";1"))
+			res.children[id] = c
+			res.names[id] = name
+		}
+	}
+	return res
+}
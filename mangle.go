@@ -1,38 +1,99 @@
 package iso9660
 
 import (
-	"path"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sort"
 	"strings"
 )
 
-func manglePath(input string) (string, string) {
-	nonEmptySegments := splitPath(path.Clean(input))
-
-	dirSegments := nonEmptySegments[:len(nonEmptySegments)-1]
-	name := nonEmptySegments[len(nonEmptySegments)-1]
-
-	for i := 0; i < len(dirSegments); i++ {
-		dirSegments[i] = mangleDirectoryName(dirSegments[i])
-	}
-	name = mangleFileName(name)
+// CollisionPolicy defines how files whose names are the same once mangled
+// to ISO 9660 identifiers are told apart.
+type CollisionPolicy int
+
+const (
+	// CollisionFail makes writing the image fail with ErrNameCollision
+	CollisionFail CollisionPolicy = iota
+	// CollisionNumeric appends a numeric suffix to the names, such as
+	// FOO_BAR~01.TXT for foo.bar.txt, or FOO_B~01.TXT at interchange level 1
+	CollisionNumeric
+	// CollisionHash appends a suffix derived from the original name, such
+	// as FOO_BAR~3A7F.TXT, which does not depend on the other names
+	CollisionHash
+)
 
-	return path.Join(dirSegments...), name
-}
+// ErrNameCollision is returned when writing an image with names that are the
+// same once mangled, with the CollisionFail policy
+var ErrNameCollision = errors.New("names are the same once mangled")
 
 func splitPath(input string) []string {
 	rawSegments := strings.Split(input, "/")
 	var nonEmptySegments []string
 	for _, s := range rawSegments {
-		if len(s) > 0 {
+		if len(s) > 0 && s != "." {
 			nonEmptySegments = append(nonEmptySegments, s)
 		}
 	}
 	return nonEmptySegments
 }
 
-// See ECMA-119 7.5
-func mangleFileName(input string) string {
-	input = strings.ToUpper(input)
+// Relaxations are deviations from the ISO 9660 naming rules, as offered
+// by mkisofs, which most readers accept
+type Relaxations struct {
+	AllowLowercase   bool // keep lowercase letters in identifiers
+	OmitVersion      bool // omit the ";1" version of file identifiers
+	LongNames        bool // allow 37 character identifiers, which implies OmitVersion
+	AllowLeadingDots bool // keep the leading dot of names such as .config
+}
+
+// mangler mangles names to ISO 9660 identifiers, according to the
+// interchange level and relaxations of an image
+type mangler struct {
+	level      int // interchange level the mangler was built for
+	fileLength int // file identifier, including extension and version
+	nameLength int // file name, without extension
+	extLength  int // file name extension
+	dirLength  int // directory identifier
+	Relaxations
+}
+
+// newMangler returns the mangler of an interchange level, 0 meaning the
+// default level 3
+func newMangler(level int, relax Relaxations) (mangler, error) {
+	m := mangler{
+		level:      level,
+		fileLength: primaryVolumeFileIdentifierMaxLength,
+		nameLength: primaryVolumeFileIdentifierMaxLength,
+		// enough characters for the `.ignition` extension
+		extLength:   8,
+		dirLength:   primaryVolumeDirectoryIdentifierMaxLength,
+		Relaxations: relax,
+	}
+
+	switch level {
+	case 0, 2, 3:
+	case 1:
+		// 8.3 names
+		m.nameLength, m.extLength, m.dirLength = 8, 3, 8
+	default:
+		return m, fmt.Errorf("invalid interchange level %d", level)
+	}
+
+	if relax.LongNames {
+		m.fileLength, m.nameLength, m.dirLength = relaxedIdentifierMaxLength, relaxedIdentifierMaxLength, relaxedIdentifierMaxLength
+		m.OmitVersion = true
+	}
+	return m, nil
+}
+
+// See ECMA-119 7.5. The file name is shortened so that suffix can be
+// appended to it.
+func (m mangler) fileName(input, suffix string) string {
+	var prefix string
+	if m.AllowLeadingDots && strings.HasPrefix(input, ".") {
+		prefix, input = ".", input[1:]
+	}
 	split := strings.Split(input, ".")
 
 	version := "1"
@@ -44,35 +105,51 @@ func mangleFileName(input string) string {
 		extension = split[len(split)-1]
 	}
 
-	// enough characters for the `.ignition` extension
-	extension = mangleDString(extension, 8)
+	extension = m.dString(extension, m.extLength)
 
-	maxRemainingFilenameLength := primaryVolumeFileIdentifierMaxLength - (1 + len(version))
+	maxRemainingFilenameLength := m.fileLength - len(prefix)
+	if !m.OmitVersion {
+		maxRemainingFilenameLength -= 1 + len(version)
+	}
 	if len(extension) > 0 {
 		maxRemainingFilenameLength -= (1 + len(extension))
 	}
+	if maxRemainingFilenameLength > m.nameLength-len(prefix) {
+		maxRemainingFilenameLength = m.nameLength - len(prefix)
+	}
 
-	filename = mangleDString(filename, maxRemainingFilenameLength)
+	filename = prefix + m.dString(filename, maxRemainingFilenameLength-len(suffix)) + suffix
 
 	if len(extension) > 0 {
-		return filename + "." + extension + ";" + version
+		filename += "." + extension
+	}
+	if m.OmitVersion {
+		return filename
 	}
-
 	return filename + ";" + version
 }
 
-// See ECMA-119 7.6
-func mangleDirectoryName(input string) string {
-	return mangleDString(input, primaryVolumeDirectoryIdentifierMaxLength)
+// See ECMA-119 7.6. The name is shortened so that suffix can be appended to
+// it.
+func (m mangler) dirName(input, suffix string) string {
+	var prefix string
+	if m.AllowLeadingDots && strings.HasPrefix(input, ".") {
+		prefix, input = ".", input[1:]
+	}
+	return prefix + m.dString(input, m.dirLength-len(prefix)-len(suffix)) + suffix
 }
 
-func mangleDString(input string, maxCharacters int) string {
-	input = strings.ToUpper(input)
+// dString replaces the characters of input which are not d-characters, or
+// lowercase letters if allowed
+func (m mangler) dString(input string, maxCharacters int) string {
+	if !m.AllowLowercase {
+		input = strings.ToUpper(input)
+	}
 
 	var mangledString string
 	for i := 0; i < len(input) && i < maxCharacters; i++ {
 		r := rune(input[i])
-		if strings.ContainsRune(dCharacters, r) {
+		if strings.ContainsRune(dCharacters, r) || m.AllowLowercase && r >= 'a' && r <= 'z' {
 			mangledString += string(r)
 		} else {
 			mangledString += "_"
@@ -81,3 +158,58 @@ func mangleDString(input string, maxCharacters int) string {
 
 	return mangledString
 }
+
+// mangleNames returns the ISO 9660 identifier of each child of dir, by
+// original name. The first of the names that are the same once mangled, in
+// the order of original names, keeps its identifier while the others get
+// a suffix according to policy, so the result does not depend on the order
+// files were added in.
+func mangleNames(dir *itemDir, m mangler, policy CollisionPolicy) (map[string]string, error) {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mangle := func(name, suffix string) string {
+		if isDir(dir.children[name]) {
+			return m.dirName(name, suffix)
+		}
+		return m.fileName(name, suffix)
+	}
+
+	res := make(map[string]string, len(names))
+	used := make(map[string]string, len(names)) // original name by identifier
+	var collisions []string
+	for _, name := range names {
+		id := mangle(name, "")
+		if other, ok := used[id]; ok {
+			if policy == CollisionFail {
+				return nil, fmt.Errorf("%w: %q and %q", ErrNameCollision, other, name)
+			}
+			collisions = append(collisions, name)
+			continue
+		}
+		res[name] = id
+		used[id] = name
+	}
+
+	for _, name := range collisions {
+		var id string
+		for n := 1; ; n++ {
+			switch policy {
+			case CollisionHash:
+				h := sha1.Sum([]byte(fmt.Sprintf("%s/%d", name, n)))
+				id = mangle(name, fmt.Sprintf("~%02X%02X", h[0], h[1]))
+			default:
+				id = mangle(name, fmt.Sprintf("~%02d", n))
+			}
+			if _, ok := used[id]; !ok {
+				break
+			}
+		}
+		res[name] = id
+		used[id] = name
+	}
+	return res, nil
+}
@@ -5,9 +5,17 @@ type itemMeta struct {
 	ownEntry     *DirectoryEntry
 	parentEntry  *DirectoryEntry
 	targetSector uint32
+	attr         *Attributes // POSIX attributes, if set
+	flags        byte        // dirFlagHidden and dirFlagAssociated, if set
+	ear          *ExtendedAttributeRecord
 }
 
 func (i *itemMeta) set(own, parent *DirectoryEntry) {
 	i.ownEntry = own
 	i.parentEntry = parent
 }
+
+// staged returns the metadata set when staging the item, without its layout
+func (i *itemMeta) staged() itemMeta {
+	return itemMeta{dirPath: i.dirPath, attr: i.attr, flags: i.flags, ear: i.ear}
+}
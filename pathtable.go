@@ -0,0 +1,204 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrTooManyDirectories is returned when an image holds more directories than
+// can be numbered in a path table
+var ErrTooManyDirectories = errors.New("too many directories for path table")
+
+// pathTableRecord is a record of a path table (ECMA-119 9.4)
+type pathTableRecord struct {
+	ExtentLocation uint32
+	ParentNumber   uint16 // number of the parent directory, starting at 1
+	Identifier     string
+}
+
+// pathTableRecordLength returns the length of a record with an identifier of
+// the given length, including the padding byte
+func pathTableRecordLength(identifierLen int) uint32 {
+	return uint32(8 + identifierLen + identifierLen%2)
+}
+
+// marshal encodes the record using the given byte order: little endian
+// for a type L path table, big endian for a type M path table
+func (r *pathTableRecord) marshal(order binary.ByteOrder) []byte {
+	data := make([]byte, pathTableRecordLength(len(r.Identifier)))
+	data[0] = byte(len(r.Identifier))
+	data[1] = 0 // extended attribute record length
+	order.PutUint32(data[2:6], r.ExtentLocation)
+	order.PutUint16(data[6:8], r.ParentNumber)
+	copy(data[8:], r.Identifier)
+	return data
+}
+
+// decodePathTable returns the records of a path table encoded with the given
+// byte order
+func decodePathTable(data []byte, order binary.ByteOrder) ([]pathTableRecord, error) {
+	var res []pathTableRecord
+	for pos := 0; pos < len(data); {
+		identifierLen := int(data[pos])
+		if identifierLen == 0 {
+			return nil, fmt.Errorf("path table record at offset %d has an empty identifier", pos)
+		}
+		recordLen := int(pathTableRecordLength(identifierLen))
+		if pos+recordLen > len(data) {
+			return nil, fmt.Errorf("path table record at offset %d is truncated", pos)
+		}
+
+		res = append(res, pathTableRecord{
+			ExtentLocation: order.Uint32(data[pos+2 : pos+6]),
+			ParentNumber:   order.Uint16(data[pos+6 : pos+8]),
+			Identifier:     string(data[pos+8 : pos+8+identifierLen]),
+		})
+		pos += recordLen
+	}
+	return res, nil
+}
+
+// pathTableDir is a directory listed in a path table being written
+type pathTableDir struct {
+	dir    *itemDir
+	name   string // directory identifier
+	parent uint16
+}
+
+// pathTableDirs returns the directories of the tree starting at root in path
+// table order (ECMA-119 6.9.1): by level, then by number of the parent
+// directory, then by identifier
+func pathTableDirs(root *itemDir) ([]pathTableDir, error) {
+	res := []pathTableDir{{dir: root, name: string([]byte{0}), parent: 1}}
+	for i := 0; i < len(res); i++ {
+		d := res[i].dir
+		for _, name := range d.sortedNames() {
+			if sub, ok := d.children[name].(*itemDir); ok {
+				res = append(res, pathTableDir{dir: sub, name: name, parent: uint16(i + 1)})
+			}
+		}
+		if len(res) > math.MaxUint16 {
+			return nil, ErrTooManyDirectories
+		}
+	}
+	return res, nil
+}
+
+// pathTables holds the path tables of a volume while it is being written
+type pathTables struct {
+	dirs   []pathTableDir
+	tables []*bufferHndlr
+}
+
+// reservePathTables allocates the path tables of the directory tree starting
+// at root and records their location and size in vd. Their contents are only
+// known once all directories have been allocated, see fill.
+func (wc *writeContext) reservePathTables(vd *PrimaryVolumeDescriptorBody, root *itemDir) (*pathTables, error) {
+	dirs, err := pathTableDirs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var size uint32
+	for _, d := range dirs {
+		size += pathTableRecordLength(len(d.name))
+	}
+
+	locations := []*int32{&vd.TypeLPathTableLoc, &vd.TypeMPathTableLoc}
+	vd.OptTypeLPathTableLoc = 0
+	vd.OptTypeMPathTableLoc = 0
+	if wc.iw.OptionalPathTables {
+		locations = []*int32{&vd.TypeLPathTableLoc, &vd.OptTypeLPathTableLoc, &vd.TypeMPathTableLoc, &vd.OptTypeMPathTableLoc}
+	}
+
+	res := &pathTables{dirs: dirs}
+	for _, loc := range locations {
+		table := &bufferHndlr{d: make([]byte, size)}
+		*loc = int32(wc.allocMetadata(table))
+		res.tables = append(res.tables, table)
+	}
+	vd.PathTableSize = int32(size)
+
+	return res, nil
+}
+
+// fill generates the contents of the path tables, once the location of all
+// directories is known. Tables are ordered as allocated: type L first.
+func (p *pathTables) fill() {
+	var l, m []byte
+	for _, d := range p.dirs {
+		r := &pathTableRecord{
+			ExtentLocation: uint32(d.dir.m.ownEntry.ExtentLocation),
+			ParentNumber:   d.parent,
+			Identifier:     d.name,
+		}
+		l = append(l, r.marshal(binary.LittleEndian)...)
+		m = append(m, r.marshal(binary.BigEndian)...)
+	}
+
+	for i, table := range p.tables {
+		if i < len(p.tables)/2 {
+			copy(table.d, l)
+		} else {
+			copy(table.d, m)
+		}
+	}
+}
+
+// maxPathTableSize is the largest path table read from an image, larger
+// tables are ignored
+const maxPathTableSize = 16 << 20
+
+// errInconsistentPathTable is used when the path tables of an image can't be
+// trusted, in which case the directory tree is used instead
+var errInconsistentPathTable = errors.New("inconsistent path tables")
+
+// readPathTables reads the type L and type M path tables of vd, and returns
+// their records if both tables are identical and well formed
+func readPathTables(ra io.ReaderAt, vd *PrimaryVolumeDescriptorBody) ([]pathTableRecord, error) {
+	if vd.PathTableSize <= 0 || vd.PathTableSize > maxPathTableSize || vd.TypeLPathTableLoc <= 0 || vd.TypeMPathTableLoc <= 0 {
+		return nil, errInconsistentPathTable
+	}
+
+	read := func(loc int32, order binary.ByteOrder) ([]pathTableRecord, error) {
+		data := make([]byte, vd.PathTableSize)
+		if _, err := ra.ReadAt(data, int64(loc)*int64(sectorSize)); err != nil {
+			return nil, err
+		}
+		return decodePathTable(data, order)
+	}
+
+	l, err := read(vd.TypeLPathTableLoc, binary.LittleEndian)
+	if err != nil {
+		return nil, err
+	}
+	m, err := read(vd.TypeMPathTableLoc, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(l) == 0 || len(l) != len(m) {
+		return nil, errInconsistentPathTable
+	}
+	for n, r := range l {
+		if r != m[n] {
+			return nil, errInconsistentPathTable
+		}
+		isRoot := r.ParentNumber == 1 && r.Identifier == string([]byte{0})
+		if n == 0 && !isRoot {
+			return nil, errInconsistentPathTable
+		}
+		// parents are always listed before their children
+		if n > 0 && (isRoot || r.ParentNumber == 0 || int(r.ParentNumber) > n) {
+			return nil, errInconsistentPathTable
+		}
+	}
+	if vd.RootDirectoryEntry == nil || l[0].ExtentLocation != uint32(vd.RootDirectoryEntry.ExtentLocation) {
+		return nil, errInconsistentPathTable
+	}
+
+	return l, nil
+}
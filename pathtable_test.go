@@ -0,0 +1,264 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterPathTables(t *testing.T) {
+	for _, optional := range []bool{false, true} {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.Joliet = true
+		w.OptionalPathTables = optional
+
+		for _, name := range []string{"b/c/file.txt", "a/z/file.txt", "a/d/file.txt", "b/file.txt", "top.txt"} {
+			assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+		}
+		assert.NoError(t, w.AddDirectory("b/empty"))
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, w.WriteTo(buf))
+		data := buf.Bytes()
+
+		image, err := OpenImage(bytes.NewReader(data))
+		assert.NoError(t, err)
+
+		volumes := 0
+		for _, vd := range image.volumeDescriptors {
+			if vd.Type() != volumeTypePrimary && !vd.isJoliet() {
+				continue
+			}
+			volumes++
+			pvd := vd.Primary
+
+			table := func(loc int32, order binary.ByteOrder) []pathTableRecord {
+				if !assert.NotZero(t, loc) {
+					return nil
+				}
+				offset := int64(loc) * int64(sectorSize)
+				records, err := decodePathTable(data[offset:offset+int64(pvd.PathTableSize)], order)
+				assert.NoError(t, err)
+				return records
+			}
+
+			l := table(pvd.TypeLPathTableLoc, binary.LittleEndian)
+			assert.Equal(t, l, table(pvd.TypeMPathTableLoc, binary.BigEndian))
+			if optional {
+				assert.Equal(t, l, table(pvd.OptTypeLPathTableLoc, binary.LittleEndian))
+				assert.Equal(t, l, table(pvd.OptTypeMPathTableLoc, binary.BigEndian))
+			} else {
+				assert.Zero(t, pvd.OptTypeLPathTableLoc)
+				assert.Zero(t, pvd.OptTypeMPathTableLoc)
+			}
+
+			names := []string{"\x00", "A", "B", "D", "Z", "C", "EMPTY"}
+			if vd.isJoliet() {
+				names = []string{"\x00", "a", "b", "d", "z", "c", "empty"}
+			}
+			parents := []uint16{1, 1, 1, 2, 2, 3, 3}
+			if !assert.Len(t, l, len(names)) {
+				continue
+			}
+
+			// each record must point to the directory with the same path
+			paths := []string{".", "a", "b", "a/d", "a/z", "b/c", "b/empty"}
+			for i, r := range l {
+				if vd.isJoliet() && i > 0 {
+					assert.Equal(t, names[i], decodeUCS2([]byte(r.Identifier)))
+				} else {
+					assert.Equal(t, names[i], r.Identifier)
+				}
+				assert.Equal(t, parents[i], r.ParentNumber)
+
+				dir := &File{de: pvd.RootDirectoryEntry, ra: image.ra, joliet: vd.isJoliet()}
+				if paths[i] != "." {
+					for _, seg := range strings.Split(paths[i], "/") {
+						dir, err = dir.lookupChild(seg)
+						if !assert.NoError(t, err) {
+							break
+						}
+					}
+				}
+				assert.Equal(t, dir.de.ExtentLocation, int32(r.ExtentLocation), paths[i])
+			}
+		}
+		assert.Equal(t, 2, volumes)
+	}
+}
+
+// recordingReaderAt records the offsets read from an image
+type recordingReaderAt struct {
+	ra    io.ReaderAt
+	reads []int64
+}
+
+func (r *recordingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads = append(r.reads, off)
+	return r.ra.ReadAt(p, off)
+}
+
+// readsExtent returns true if any recorded read started within the extent
+// of f
+func (r *recordingReaderAt) readsExtent(f *File) bool {
+	start := int64(f.de.ExtentLocation) * int64(sectorSize)
+	for _, off := range r.reads {
+		if off >= start && off < start+int64(f.de.ExtentLength) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestImageLookup(t *testing.T) {
+	for _, testcase := range []struct {
+		joliet, rockRidge bool
+	}{{false, false}, {true, false}, {false, true}} {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.Joliet = testcase.joliet
+		w.RockRidge = testcase.rockRidge
+
+		assert.NoError(t, w.AddFile(strings.NewReader("deep"), "a/b/c/file.txt"))
+		for i := 0; i < 300; i++ {
+			name := fmt.Sprintf("big/file%03d", i)
+			assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+		}
+
+		buf := &bytes.Buffer{}
+		assert.NoError(t, w.WriteTo(buf))
+		data := buf.Bytes()
+
+		// reference entries, found by walking the tree
+		ref, err := OpenImage(bytes.NewReader(data))
+		assert.NoError(t, err)
+		walk := func(name string) *File {
+			f, err := ref.resolve("walk", name)
+			assert.NoError(t, err)
+			return f
+		}
+
+		ra := &recordingReaderAt{ra: bytes.NewReader(data)}
+		image, err := OpenImage(ra)
+		assert.NoError(t, err)
+		ra.reads = nil
+
+		f, err := image.Lookup("/a/b/c/file.txt")
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "file.txt", strings.ToLower(f.Name()))
+		content, err := ioutil.ReadAll(f.Reader())
+		assert.NoError(t, err)
+		assert.Equal(t, "deep", string(content))
+
+		// only the final directory is read, along with its parent to check
+		// its Rock Ridge name
+		assert.True(t, ra.readsExtent(walk("a/b/c")))
+		assert.False(t, ra.readsExtent(walk("big")))
+		assert.False(t, ra.readsExtent(walk("a")))
+		assert.Equal(t, testcase.rockRidge, ra.readsExtent(walk("a/b")))
+
+		f, err = image.Lookup("a/b")
+		assert.NoError(t, err)
+		assert.True(t, f.IsDir())
+		assert.Equal(t, "b", strings.ToLower(f.Name()))
+
+		f, err = image.Lookup("/")
+		assert.NoError(t, err)
+		assert.True(t, f.IsDir())
+
+		_, err = image.Lookup("a/b/missing.txt")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+		_, err = image.Lookup("a/missing/file.txt")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+	}
+}
+
+func TestImageLookupRockRidge(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	w.Collisions = CollisionNumeric
+
+	files := []string{"Some.Dir/lower/sub dir/file.txt", "other/file.txt", "case/Same/file.txt", "case/same/file.txt"}
+	for _, name := range files {
+		assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+	data := buf.Bytes()
+
+	ref, err := OpenImage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	walk := func(name string) *File {
+		f, err := ref.resolve("walk", name)
+		assert.NoError(t, err)
+		return f
+	}
+
+	for _, name := range files {
+		ra := &recordingReaderAt{ra: bytes.NewReader(data)}
+		image, err := OpenImage(ra)
+		assert.NoError(t, err)
+		ra.reads = nil
+
+		f, err := image.Lookup(name)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		content, err := ioutil.ReadAll(f.Reader())
+		assert.NoError(t, err)
+		assert.Equal(t, name, string(content))
+
+		if name == files[0] {
+			// directories were found through the path table
+			assert.False(t, ra.readsExtent(walk("Some.Dir")))
+			assert.True(t, ra.readsExtent(walk("Some.Dir/lower")))
+			assert.True(t, ra.readsExtent(walk("Some.Dir/lower/sub dir")))
+		}
+	}
+}
+
+func TestImageLookupInconsistentPathTable(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddFile(strings.NewReader("deep"), "a/b/c/file.txt"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+	data := buf.Bytes()
+
+	image, err := OpenImage(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	// break the location of the root in the type M path table, so it no
+	// longer matches the type L table
+	data[int64(image.primaryVolume().TypeMPathTableLoc)*int64(sectorSize)+5] ^= 0xff
+
+	ra := &recordingReaderAt{ra: bytes.NewReader(data)}
+	image, err = OpenImage(ra)
+	assert.NoError(t, err)
+
+	f, err := image.Lookup("a/b/c/file.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(4), f.Size())
+	}
+
+	// the tree was walked
+	root, err := image.RootDir()
+	assert.NoError(t, err)
+	a, err := root.lookupChild("a")
+	assert.NoError(t, err)
+	assert.True(t, ra.readsExtent(a))
+}
@@ -0,0 +1,141 @@
+package iso9660
+
+import (
+	"io"
+	"path"
+	"sync"
+)
+
+// Plan is the layout of an image, computed before it gets written. Its
+// fields describe the image written by WriteTo, changing them has no effect
+// on the image.
+type Plan struct {
+	TotalSectors      uint32              // TotalSectors is the size of the image in 2048-byte sectors
+	VolumeDescriptors []PlannedDescriptor // VolumeDescriptors lists the volume descriptors, from sector 16
+	BootCatalog       uint32              // BootCatalog is the location of the El Torito boot catalog, 0 if none
+
+	// Files holds the extent of each file and directory of the image, by
+	// path of ISO 9660 identifiers in the primary volume, as returned by
+	// MangledPath, such as "DOCS/HELLO.TXT;1". The root directory is ".".
+	Files map[string]PlannedExtent
+
+	wc   *writeContext
+	lock sync.Mutex // serializes writes
+}
+
+// PlannedDescriptor is a volume descriptor of a Plan
+type PlannedDescriptor struct {
+	Sector uint32
+	Type   byte // 0 for the boot record, 1 for the primary volume, 2 for supplementary volumes, 255 for the terminator
+}
+
+// PlannedExtent is the location of a file or directory in a Plan, as found
+// in its directory record. Files larger than 4GB span several contiguous
+// extents.
+type PlannedExtent struct {
+	Path     string // path as added to the ImageWriter, empty for the RR_MOVED directory
+	Location uint32 // first sector, starting with the extended attribute record if any
+	Length   int64  // in bytes, not counting the extended attribute record
+
+	// ExtendedAttributeRecordLength is the number of sectors of the extended
+	// attribute record, the data starting right after it
+	ExtendedAttributeRecordLength uint8
+}
+
+// Plan lays out the image and returns its layout, to be written with the
+// WriteTo method of the plan.
+func (iw *ImageWriter) Plan() (*Plan, error) {
+	wc, err := iw.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Plan{
+		TotalSectors: wc.freeSectorPointer,
+		Files:        make(map[string]PlannedExtent),
+		wc:           wc,
+	}
+	for i, vd := range wc.vd {
+		res.VolumeDescriptors = append(res.VolumeDescriptors, PlannedDescriptor{Sector: uint32(16 + i), Type: vd.Header.Type})
+	}
+	if wc.bootCatalog != nil {
+		res.BootCatalog = wc.bootCatalog.meta().targetSector
+	}
+
+	var walk func(dir *itemDir, name, id string)
+	walk = func(dir *itemDir, name, id string) {
+		res.Files[id] = PlannedExtent{Path: name, Location: dir.meta().targetSector, Length: dir.Size()}
+		for _, cID := range dir.sortedNames() {
+			cName, cPath := path.Join(name, dir.names[cID]), path.Join(id, cID)
+			c := dir.children[cID]
+			if sub, ok := wc.relocated[c]; ok {
+				// relocated directories are listed with their original path
+				for movedID, other := range wc.rrMoved.children {
+					if other == Item(sub) {
+						walk(sub, cName, path.Join(rrMovedIdentifier, movedID))
+					}
+				}
+				continue
+			}
+			if sub, ok := c.(*itemDir); ok {
+				if sub != wc.rrMoved {
+					walk(sub, cName, cPath)
+				}
+				continue
+			}
+			extent := PlannedExtent{Path: cName, Location: c.meta().targetSector, Length: c.Size()}
+			if own := c.meta().ownEntry; own != nil {
+				extent.Location = uint32(own.ExtentLocation)
+				extent.ExtendedAttributeRecordLength = own.ExtendedAtributeRecordLength
+			}
+			res.Files[cPath] = extent
+		}
+	}
+	walk(wc.root, ".", ".")
+	if wc.rrMoved != nil {
+		res.Files[rrMovedIdentifier] = PlannedExtent{Location: wc.rrMoved.meta().targetSector, Length: wc.rrMoved.Size()}
+	}
+
+	return res, nil
+}
+
+// WriteTo writes the image laid out by the plan to w. A plan can be written
+// several times, giving the same image, concurrent writes being serialized.
+func (p *Plan) WriteTo(w io.Writer) (int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	wc := p.wc
+	wc.w, wc.writeSecPos = w, 0
+	written := func() int64 {
+		return int64(wc.writeSecPos) * int64(sectorSize)
+	}
+
+	// write the 16 sectors of system area
+	if err := wc.writeSector(wc.area, 0); err != nil {
+		return written(), err
+	}
+
+	// write volume descriptors
+	for i, pvd := range wc.vd {
+		if err := wc.writeDescriptor(pvd, uint32(16+i)); err != nil {
+			return written(), err
+		}
+	}
+
+	// this actually writes the data to the disk
+	for _, buf := range wc.items {
+		if err := wc.writeItem(buf); err != nil {
+			return written(), err
+		}
+	}
+
+	return written(), nil
+}
+
+// writeItem writes the contents of it to the image, closing it once written
+// or on failure
+func (wc *writeContext) writeItem(it Item) error {
+	defer it.Close()
+	return wc.writeSectorBuf(it)
+}
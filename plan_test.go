@@ -0,0 +1,111 @@
+package iso9660
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterPlan(t *testing.T) {
+	w := newBootTestWriter(t)
+	w.Joliet = true
+	w.RockRidge = true // original names in the primary volume
+	assert.NoError(t, w.AddFile(strings.NewReader("hello"), "docs/Hello World.txt"))
+	assert.NoError(t, w.AddFile(bytes.NewReader(make([]byte, 5000)), "data.bin"))
+	assert.NoError(t, w.AddDirectory("empty"))
+	assert.NoError(t, w.AddFile(strings.NewReader("attributes"), "ear.txt"))
+	assert.NoError(t, w.SetExtendedAttributes("ear.txt", &ExtendedAttributeRecord{OwnerIdentification: 1000}))
+
+	plan, err := w.Plan()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []PlannedDescriptor{{16, volumeTypePrimary}, {17, volumeTypeBoot}, {18, volumeTypeSupplementary}, {19, volumeTypeTerminator}}, plan.VolumeDescriptors)
+	assert.Len(t, plan.Files, 9)
+	assert.Equal(t, PlannedExtent{Path: "data.bin", Location: plan.Files["DATA.BIN;1"].Location, Length: 5000}, plan.Files["DATA.BIN;1"])
+	assert.Equal(t, uint8(1), plan.Files["EAR.TXT;1"].ExtendedAttributeRecordLength)
+	assert.Equal(t, ".", plan.Files["."].Path)
+	for id, extent := range plan.Files {
+		if id != "." {
+			mangled, err := w.MangledPath(extent.Path)
+			assert.NoError(t, err)
+			assert.Equal(t, mangled, id)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := plan.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, int64(plan.TotalSectors)*int64(sectorSize), n)
+
+	// plans can be written again
+	again := &bytes.Buffer{}
+	_, err = plan.WriteTo(again)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(buf.Bytes(), again.Bytes()))
+
+	// extents of directories are the ones of the primary volume
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()), IgnoreJoliet())
+	if !assert.NoError(t, err) {
+		return
+	}
+	catalog, err := image.BootCatalog()
+	assert.NoError(t, err)
+	assert.Equal(t, catalog.Location, plan.BootCatalog)
+
+	for id, extent := range plan.Files {
+		name := extent.Path
+		f, err := image.Lookup(name)
+		if !assert.NoError(t, err, id) {
+			continue
+		}
+		assert.Equal(t, extent.Location, uint32(f.de.ExtentLocation), name)
+		assert.Equal(t, extent.ExtendedAttributeRecordLength, f.de.ExtendedAtributeRecordLength, name)
+		if !f.IsDir() {
+			assert.Equal(t, extent.Length, f.Size(), name)
+		}
+	}
+}
+
+// failingReader returns an error after its data, and records it was closed
+type failingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = errors.New("read failure")
+	}
+	return n, err
+}
+
+func (r *failingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestPlanWriteToFailure(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+
+	r := &failingReader{Reader: bytes.NewReader(make([]byte, 3000))}
+	item := NewItemFunc(5000, func() (io.ReadCloser, error) {
+		return r, nil
+	})
+	assert.NoError(t, w.AddFile(item, "broken.bin"))
+
+	plan, err := w.Plan()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = plan.WriteTo(&bytes.Buffer{})
+	assert.EqualError(t, err, "read failure")
+	assert.True(t, r.closed)
+}
@@ -0,0 +1,90 @@
+package iso9660
+
+import (
+	"io"
+)
+
+// renderItem is a staged item as seen by a single write: it has its own
+// layout metadata, and reads the contents of the staged item from a file
+// opened for this write only, so the staged item can be written again.
+type renderItem struct {
+	Item
+	m itemMeta
+	f itemFile
+	r *io.SectionReader
+}
+
+func (r *renderItem) Read(p []byte) (int, error) {
+	if r.r == nil {
+		f, err := r.Item.open()
+		if err != nil {
+			return 0, err
+		}
+		r.f = f
+		r.r = io.NewSectionReader(f, 0, r.Size())
+	}
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		if pos, _ := r.r.Seek(0, io.SeekCurrent); pos < r.Size() {
+			// the contents changed since the item was staged
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+func (r *renderItem) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f, r.r = nil, nil
+	return err
+}
+
+func (r *renderItem) meta() *itemMeta {
+	return &r.m
+}
+
+// render returns the item to lay out in place of the staged item it, so
+// that the staged tree is never modified by a write. An item found several
+// times in the tree is rendered once.
+func (wc *writeContext) render(it Item) Item {
+	if res, ok := wc.rendered[it]; ok {
+		return res
+	}
+
+	var res Item
+	switch v := it.(type) {
+	case *itemNode:
+		res = &itemNode{target: v.target, m: v.m.staged()}
+	default:
+		res = &renderItem{Item: it, m: it.meta().staged()}
+	}
+	wc.rendered[it] = res
+	return res
+}
+
+// renderDir returns a copy of the staged directory d along with its
+// children, indexed by their ISO 9660 identifiers
+func (wc *writeContext) renderDir(d *itemDir) (*itemDir, error) {
+	ids, err := mangleNames(d, wc.mangler, wc.iw.Collisions)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := newDir()
+	dir.m = d.m.staged()
+	for name, c := range d.children {
+		id := ids[name]
+		if sub, ok := c.(*itemDir); ok {
+			if dir.children[id], err = wc.renderDir(sub); err != nil {
+				return nil, err
+			}
+		} else {
+			dir.children[id] = wc.render(c)
+		}
+		dir.names[id] = name
+	}
+	return dir, nil
+}
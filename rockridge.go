@@ -0,0 +1,616 @@
+package iso9660
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Rock Ridge Interchange Protocol
+// see: IEEE P1282 (RRIP 1.12)
+
+// extension identifiers found in ER entries of Rock Ridge volumes
+var rripIdentifiers = []string{"RRIP_1991A", "IEEE_P1282", "IEEE_1282"}
+
+// POSIX file mode bits as stored in PX entries
+const (
+	posixTypeMask   = 0170000
+	posixSocket     = 0140000
+	posixSymlink    = 0120000
+	posixRegular    = 0100000
+	posixBlockDev   = 0060000
+	posixDirectory  = 0040000
+	posixCharDev    = 0020000
+	posixFIFO       = 0010000
+	posixSetuid     = 04000
+	posixSetgid     = 02000
+	posixSticky     = 01000
+	posixPermission = 0777
+)
+
+// TF entry flags
+const (
+	tfCreation = 1 << iota
+	tfModify
+	tfAccess
+	tfAttributes
+	tfBackup
+	tfExpiration
+	tfEffective
+	tfLongForm
+)
+
+// NM and SL component flags
+const (
+	rrFlagContinue = 1 << iota
+	rrFlagCurrent
+	rrFlagParent
+	rrFlagRoot
+)
+
+// RockRidgeInfo holds the POSIX attributes of an entry as recorded by the Rock
+// Ridge extensions. It is the value returned by File.Sys() on Rock Ridge
+// volumes.
+type RockRidgeInfo struct {
+	Mode          uint32 // POSIX st_mode, including the file type bits
+	Links         uint32 // POSIX st_nlink
+	UID           uint32
+	GID           uint32
+	Inode         uint32 // POSIX st_ino, 0 if not recorded (RRIP 1.10)
+	Device        uint64 // POSIX st_rdev for character and block devices
+	Name          string // alternate name (NM)
+	SymlinkTarget string // symbolic link target (SL)
+
+	CreationTime     time.Time
+	ModificationTime time.Time
+	AccessTime       time.Time
+	ChangeTime       time.Time
+
+	ChildLink  int32 // CL: location of a relocated directory, or 0
+	ParentLink int32 // PL: location of the original parent of a relocated directory, or 0
+	Relocated  bool  // RE: this entry is a relocated directory and should not be listed
+}
+
+// rripExtension returns true if e is an ER entry describing Rock Ridge
+func rripExtension(e suspEntry) bool {
+	if len(e.Data) < 4 {
+		return false
+	}
+	idLen := int(e.Data[0])
+	if 4+idLen > len(e.Data) {
+		return false
+	}
+	id := string(e.Data[4 : 4+idLen])
+	for _, v := range rripIdentifiers {
+		if id == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRockRidge builds a RockRidgeInfo from a list of System Use Entries
+func parseRockRidge(entries []suspEntry) (*RockRidgeInfo, error) {
+	rr := &RockRidgeInfo{}
+	var (
+		err            error
+		name           strings.Builder
+		symlink        strings.Builder
+		symlinkPending bool // last SL component is continued in next entry
+	)
+
+	for _, e := range entries {
+		d := e.Data
+		switch e.Signature {
+		case "PX":
+			if len(d) < 32 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			var v [4]int32
+			for i := range v {
+				if v[i], err = UnmarshalInt32LSBMSB(d[i*8 : i*8+8]); err != nil {
+					return nil, err
+				}
+			}
+			rr.Mode, rr.Links, rr.UID, rr.GID = uint32(v[0]), uint32(v[1]), uint32(v[2]), uint32(v[3])
+			if len(d) >= 40 {
+				ino, err := UnmarshalInt32LSBMSB(d[32:40])
+				if err != nil {
+					return nil, err
+				}
+				rr.Inode = uint32(ino)
+			}
+		case "PN":
+			if len(d) < 16 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			high, err := UnmarshalInt32LSBMSB(d[0:8])
+			if err != nil {
+				return nil, err
+			}
+			low, err := UnmarshalInt32LSBMSB(d[8:16])
+			if err != nil {
+				return nil, err
+			}
+			rr.Device = uint64(uint32(high))<<32 | uint64(uint32(low))
+		case "NM":
+			if len(d) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			switch {
+			case d[0]&rrFlagCurrent != 0:
+				name.WriteString(".")
+			case d[0]&rrFlagParent != 0:
+				name.WriteString("..")
+			default:
+				name.Write(d[1:])
+			}
+		case "SL":
+			if len(d) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			for comp := d[1:]; len(comp) >= 2; {
+				flags, compLen := comp[0], int(comp[1])
+				if 2+compLen > len(comp) {
+					return nil, io.ErrUnexpectedEOF
+				}
+				if symlink.Len() > 0 && !symlinkPending && !strings.HasSuffix(symlink.String(), "/") {
+					symlink.WriteByte('/')
+				}
+				switch {
+				case flags&rrFlagRoot != 0:
+					symlink.WriteByte('/')
+				case flags&rrFlagCurrent != 0:
+					symlink.WriteString(".")
+				case flags&rrFlagParent != 0:
+					symlink.WriteString("..")
+				default:
+					symlink.Write(comp[2 : 2+compLen])
+				}
+				symlinkPending = flags&rrFlagContinue != 0
+				comp = comp[2+compLen:]
+			}
+		case "TF":
+			if len(d) < 1 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if err = rr.parseTimestamps(d[0], d[1:]); err != nil {
+				return nil, err
+			}
+		case "CL":
+			if len(d) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if rr.ChildLink, err = UnmarshalInt32LSBMSB(d[0:8]); err != nil {
+				return nil, err
+			}
+		case "PL":
+			if len(d) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if rr.ParentLink, err = UnmarshalInt32LSBMSB(d[0:8]); err != nil {
+				return nil, err
+			}
+		case "RE":
+			rr.Relocated = true
+		}
+	}
+
+	rr.Name = name.String()
+	rr.SymlinkTarget = symlink.String()
+	return rr, nil
+}
+
+// parseTimestamps decodes the timestamps of a TF entry
+func (rr *RockRidgeInfo) parseTimestamps(flags byte, d []byte) error {
+	size := 7
+	if flags&tfLongForm != 0 {
+		size = 17
+	}
+
+	for _, v := range []struct {
+		flag byte
+		t    *time.Time
+	}{
+		{tfCreation, &rr.CreationTime},
+		{tfModify, &rr.ModificationTime},
+		{tfAccess, &rr.AccessTime},
+		{tfAttributes, &rr.ChangeTime},
+		{tfBackup, nil},
+		{tfExpiration, nil},
+		{tfEffective, nil},
+	} {
+		if flags&v.flag == 0 {
+			continue
+		}
+		if len(d) < size {
+			return io.ErrUnexpectedEOF
+		}
+
+		if v.t != nil {
+			if size == 7 {
+				var ts RecordingTimestamp
+				if err := ts.UnmarshalBinary(d[:size]); err != nil {
+					return err
+				}
+				*v.t = time.Time(ts)
+			} else {
+				var ts VolumeDescriptorTimestamp
+				if err := ts.UnmarshalBinary(d[:size]); err != nil {
+					return err
+				}
+				*v.t = ts.Time()
+			}
+		}
+		d = d[size:]
+	}
+	return nil
+}
+
+// FileMode converts the POSIX mode of the entry to an os.FileMode
+func (rr *RockRidgeInfo) FileMode() os.FileMode {
+	mode := os.FileMode(rr.Mode & posixPermission)
+
+	switch rr.Mode & posixTypeMask {
+	case posixDirectory:
+		mode |= os.ModeDir
+	case posixSymlink:
+		mode |= os.ModeSymlink
+	case posixSocket:
+		mode |= os.ModeSocket
+	case posixFIFO:
+		mode |= os.ModeNamedPipe
+	case posixBlockDev:
+		mode |= os.ModeDevice
+	case posixCharDev:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	}
+
+	if rr.Mode&posixSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if rr.Mode&posixSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if rr.Mode&posixSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// contents of the ER entry written on Rock Ridge volumes
+const (
+	rripIdentifier  = "RRIP_1991A"
+	rripDescription = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rripSource      = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// directory holding the directories relocated because of their depth, as
+// named by mkisofs
+const (
+	rrMovedIdentifier = "RR_MOVED"
+	rrMovedName       = "rr_moved"
+)
+
+// maximum amount of data in a single NM or SL entry
+const rrMaxEntryData = 250
+
+// posixMode converts the mode of an entry to a POSIX st_mode
+func posixMode(mode os.FileMode, it Item) uint32 {
+	res := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		res |= posixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		res |= posixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		res |= posixSticky
+	}
+
+	_, special := it.(*itemNode)
+	switch {
+	case isDir(it):
+		res |= posixDirectory
+	case !special:
+		res |= posixRegular
+	case mode&os.ModeSymlink != 0:
+		res |= posixSymlink
+	case mode&os.ModeCharDevice != 0:
+		res |= posixCharDev
+	case mode&os.ModeDevice != 0:
+		res |= posixBlockDev
+	case mode&os.ModeNamedPipe != 0:
+		res |= posixFIFO
+	case mode&os.ModeSocket != 0:
+		res |= posixSocket
+	}
+	return res
+}
+
+// encodeSP returns the SP entry found at the start of the root's "." record
+func encodeSP() []byte {
+	return encodeSUSPEntry("SP", []byte{0xbe, 0xef, 0})
+}
+
+// encodeER returns the ER entry identifying Rock Ridge
+func encodeER() []byte {
+	data := []byte{byte(len(rripIdentifier)), byte(len(rripDescription)), byte(len(rripSource)), 1}
+	data = append(data, rripIdentifier...)
+	data = append(data, rripDescription...)
+	data = append(data, rripSource...)
+	return encodeSUSPEntry("ER", data)
+}
+
+// encodePX encodes the POSIX attributes of an entry
+func encodePX(mode, links, uid, gid, ino uint32) []byte {
+	data := make([]byte, 40)
+	for i, v := range []uint32{mode, links, uid, gid, ino} {
+		WriteInt32LSBMSB(data[i*8:i*8+8], int32(v))
+	}
+	return encodeSUSPEntry("PX", data)
+}
+
+// encodePN encodes the device number of a device node
+func encodePN(dev uint64) []byte {
+	data := make([]byte, 16)
+	WriteInt32LSBMSB(data[0:8], int32(dev>>32))
+	WriteInt32LSBMSB(data[8:16], int32(dev))
+	return encodeSUSPEntry("PN", data)
+}
+
+// encodeTF encodes the modification, access and attribute change times of an
+// entry
+func encodeTF(t time.Time) []byte {
+	data := make([]byte, 1+3*7)
+	data[0] = tfModify | tfAccess | tfAttributes
+	for i := 0; i < 3; i++ {
+		RecordingTimestamp(t).MarshalBinary(data[1+i*7:])
+	}
+	return encodeSUSPEntry("TF", data)
+}
+
+// encodeNM encodes an alternate name, split over several entries if needed
+func encodeNM(name string) [][]byte {
+	var res [][]byte
+	for {
+		var flags byte
+		part := name
+		if len(part) > rrMaxEntryData-1 {
+			part = part[:rrMaxEntryData-1]
+			flags = rrFlagContinue
+		}
+		res = append(res, encodeSUSPEntry("NM", append([]byte{flags}, part...)))
+		name = name[len(part):]
+		if name == "" {
+			return res
+		}
+	}
+}
+
+// encodeSL encodes a symbolic link target, split over several entries if
+// needed
+func encodeSL(target string) [][]byte {
+	var comps [][]byte
+	if strings.HasPrefix(target, "/") {
+		comps = append(comps, []byte{rrFlagRoot, 0})
+	}
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "":
+		case ".":
+			comps = append(comps, []byte{rrFlagCurrent, 0})
+		case "..":
+			comps = append(comps, []byte{rrFlagParent, 0})
+		default:
+			// long components are continued in the next component
+			max := rrMaxEntryData - 3
+			for len(part) > max {
+				comps = append(comps, append([]byte{rrFlagContinue, byte(max)}, part[:max]...))
+				part = part[max:]
+			}
+			comps = append(comps, append([]byte{0, byte(len(part))}, part...))
+		}
+	}
+
+	datas := [][]byte{{0}}
+	for _, c := range comps {
+		cur := &datas[len(datas)-1]
+		if len(*cur)+len(c) > rrMaxEntryData {
+			// this SL entry is continued in the next one
+			(*cur)[0] = rrFlagContinue
+			datas = append(datas, []byte{0})
+			cur = &datas[len(datas)-1]
+		}
+		*cur = append(*cur, c...)
+	}
+
+	res := make([][]byte, len(datas))
+	for i, data := range datas {
+		res[i] = encodeSUSPEntry("SL", data)
+	}
+	return res
+}
+
+// encodeLink encodes a CL or PL entry pointing to the directory at location
+func encodeLink(sig string, location uint32) []byte {
+	data := make([]byte, 8)
+	WriteInt32LSBMSB(data, int32(location))
+	return encodeSUSPEntry(sig, data)
+}
+
+// encodeRE returns the RE entry marking a relocated directory
+func encodeRE() []byte {
+	return encodeSUSPEntry("RE", nil)
+}
+
+// rockRidgeEntries returns the Rock Ridge entries describing it. name is
+// omitted for "." and ".." records.
+func (wc *writeContext) rockRidgeEntries(it Item, name string, ino, links uint32) [][]byte {
+	attr := wc.attributes(it)
+
+	res := [][]byte{encodePX(posixMode(attr.Mode, it), links, attr.UID, attr.GID, ino)}
+	if attr.Mode&os.ModeDevice != 0 {
+		res = append(res, encodePN(attr.Device))
+	}
+	if node, ok := it.(*itemNode); ok && node.target != "" {
+		res = append(res, encodeSL(node.target)...)
+	}
+	if name != "" {
+		res = append(res, encodeNM(name)...)
+	}
+	return append(res, encodeTF(attr.ModTime))
+}
+
+// prepareRockRidge computes the Rock Ridge entries of every record of the
+// primary hierarchy, so that directory sizes account for them
+func (wc *writeContext) prepareRockRidge(root *itemDir) {
+	// link counts: directories are linked from their parent, their own "."
+	// and the ".." of each subdirectory
+	links := make(map[Item]uint32)
+	var countLinks func(dir *itemDir)
+	countLinks = func(dir *itemDir) {
+		links[dir] += 2
+		if dir == wc.rrMoved {
+			// relocated directories are counted in their original parent
+			return
+		}
+		for _, c := range dir.children {
+			if sub, ok := wc.relocated[c]; ok {
+				c = sub
+			}
+			if sub, ok := c.(*itemDir); ok {
+				links[dir]++
+				countLinks(sub)
+			} else {
+				links[c]++
+			}
+		}
+	}
+	countLinks(root)
+
+	// inodes are assigned in a deterministic order, and shared by hard links
+	inodes := make(map[Item]uint32)
+	inode := func(it Item) uint32 {
+		if v, ok := inodes[it]; ok {
+			return v
+		}
+		inodes[it] = uint32(len(inodes) + 1)
+		return inodes[it]
+	}
+
+	// CL and PL locations are only known once directories get allocated,
+	// see resolveLinks
+	var walk func(dir, parent *itemDir)
+	walk = func(dir, parent *itemDir) {
+		dir.su = make(map[string][][]byte)
+
+		self := wc.rockRidgeEntries(dir, "", inode(dir), links[dir])
+		if dir == root {
+			self = append(append([][]byte{encodeSP()}, self...), encodeER())
+		}
+		dir.su[string([]byte{0})] = self
+		dir.su[string([]byte{1})] = wc.rockRidgeEntries(parent, "", inode(parent), links[parent])
+		if _, ok := wc.parents[dir]; ok {
+			dir.su[string([]byte{1})] = append(dir.su[string([]byte{1})], encodeLink("PL", 0))
+		}
+
+		for _, name := range dir.sortedNames() {
+			c := dir.children[name]
+			if sub, ok := wc.relocated[c]; ok {
+				// placeholder, described as the directory it links to
+				dir.su[name] = append(wc.rockRidgeEntries(sub, dir.names[name], inode(sub), links[sub]), encodeLink("CL", 0))
+				continue
+			}
+			dir.su[name] = wc.rockRidgeEntries(c, dir.names[name], inode(c), links[c])
+			sub, ok := c.(*itemDir)
+			if !ok {
+				continue
+			}
+			if p, ok := wc.parents[sub]; ok {
+				dir.su[name] = append(dir.su[name], encodeRE())
+				walk(sub, p)
+			} else {
+				walk(sub, dir)
+			}
+		}
+	}
+	walk(root, root)
+}
+
+// relocateDirectories moves the directories of the tree starting at root
+// which are deeper than 8 levels to a RR_MOVED directory at the root (RRIP
+// 4.1.5). Each leaves in its parent an empty file record whose CL entry links
+// to it, while its RE entry hides it from RR_MOVED and the PL entry of its
+// ".." record links back to its original parent.
+func (wc *writeContext) relocateDirectories(root *itemDir) error {
+	var walk func(dir *itemDir, level int) error
+	walk = func(dir *itemDir, level int) error {
+		for _, name := range dir.sortedNames() {
+			sub, ok := dir.children[name].(*itemDir)
+			if !ok {
+				continue
+			}
+			if level < maxDirectoryLevels {
+				if err := walk(sub, level+1); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if wc.rrMoved == nil {
+				if _, ok := root.children[rrMovedIdentifier]; ok {
+					return fmt.Errorf("relocating %s: %w", sub.m.dirPath, os.ErrExist)
+				}
+				wc.rrMoved = newDir()
+				wc.rrMoved.m.attr = root.m.attr
+				root.children[rrMovedIdentifier] = wc.rrMoved
+				root.names[rrMovedIdentifier] = rrMovedName
+				wc.relocated = make(map[Item]*itemDir)
+				wc.parents = make(map[*itemDir]*itemDir)
+			}
+
+			// identifiers of directories from different parents may collide
+			id := name
+			for n := 1; wc.rrMoved.children[id] != nil; n++ {
+				id = wc.mangler.dirName(dir.names[name], fmt.Sprintf("~%02d", n))
+			}
+			placeholder := &itemNode{m: sub.m.staged()}
+			dir.children[name] = placeholder
+			wc.rrMoved.children[id] = sub
+			wc.rrMoved.names[id] = dir.names[name]
+			wc.relocated[placeholder] = sub
+			wc.parents[sub] = dir
+
+			// RR_MOVED is at level 2
+			if err := walk(sub, 3); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, 1)
+}
+
+// resolveLinks sets the locations of the CL and PL entries of the records
+// of dir, which point to directories allocated by now
+func (wc *writeContext) resolveLinks(dir *itemDir) {
+	setLocation := func(entries [][]byte, sig string, location uint32) {
+		for _, e := range entries {
+			if string(e[:2]) == sig {
+				WriteInt32LSBMSB(e[4:12], int32(location))
+			}
+		}
+	}
+
+	if p, ok := wc.parents[dir]; ok {
+		setLocation(dir.su[string([]byte{1})], "PL", p.meta().targetSector)
+	}
+	for name, c := range dir.children {
+		if sub, ok := wc.relocated[c]; ok {
+			setLocation(dir.su[name], "CL", sub.meta().targetSector)
+		}
+	}
+}
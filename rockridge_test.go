@@ -0,0 +1,358 @@
+package iso9660
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func suspTestEntry(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func bothEndian32(v int32) []byte {
+	res := make([]byte, 8)
+	WriteInt32LSBMSB(res, v)
+	return res
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// buildRockRidgeTestImage builds a minimal Rock Ridge image containing a
+// file, a symbolic link, a relocated directory and a continuation area
+func buildRockRidgeTestImage(t *testing.T) []byte {
+	img := make([]byte, 22*sectorSize)
+
+	px := func(mode int32, uid int32) []byte {
+		return suspTestEntry("PX", concatBytes(bothEndian32(mode), bothEndian32(1), bothEndian32(uid), bothEndian32(uid), bothEndian32(42))...)
+	}
+	mtime := make([]byte, 7)
+	RecordingTimestamp(time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)).MarshalBinary(mtime)
+
+	dirDE := func(id string, sector int32, su []byte) DirectoryEntry {
+		return DirectoryEntry{ExtentLocation: sector, ExtentLength: int32(sectorSize), FileFlags: dirFlagDir, VolumeSequenceNumber: 1, Identifier: id, SystemUse: su}
+	}
+	writeDir := func(sector int32, entries ...DirectoryEntry) {
+		pos := int(sector) * int(sectorSize)
+		for _, de := range entries {
+			data, err := de.MarshalBinary()
+			assert.NoError(t, err)
+			pos += copy(img[pos:], data)
+		}
+	}
+
+	rootDE := dirDE(string([]byte{0}), 18, nil)
+	vd := volumeDescriptor{
+		Header:  volumeDescriptorHeader{Type: volumeTypePrimary, Identifier: standardIdentifierBytes, Version: 1},
+		Primary: &PrimaryVolumeDescriptorBody{VolumeIdentifier: "RR", VolumeSpaceSize: 22, VolumeSetSize: 1, VolumeSequenceNumber: 1, LogicalBlockSize: int16(sectorSize), RootDirectoryEntry: &rootDE},
+	}
+	data, err := vd.MarshalBinary()
+	assert.NoError(t, err)
+	copy(img[16*sectorSize:], data)
+	data, err = volumeDescriptor{Header: volumeDescriptorHeader{Type: volumeTypeTerminator, Identifier: standardIdentifierBytes, Version: 1}}.MarshalBinary()
+	assert.NoError(t, err)
+	copy(img[17*sectorSize:], data)
+
+	er := suspTestEntry("ER", append([]byte{10, 0, 0, 1}, "RRIP_1991A"...)...)
+	rootSU := concatBytes(suspTestEntry("SP", 0xbe, 0xef, 0), px(040755, 0), er)
+
+	fileSU := concatBytes(px(0100640, 1000), suspTestEntry("NM", append([]byte{0}, "Mixed Case Name.tar.gz"...)...), suspTestEntry("TF", append([]byte{tfModify}, mtime...)...))
+	linkSU := concatBytes(px(0120777, 0),
+		suspTestEntry("SL", 1, rrFlagRoot, 0, 0, 3, 'u', 's', 'r', rrFlagContinue, 2, 'l', 'i'),
+		suspTestEntry("SL", 0, 0, 1, 'b', rrFlagParent, 0, 0, 3, 'b', 'i', 'n'),
+		suspTestEntry("NM", append([]byte{0}, "link"...)...))
+	// the name of this file is stored in a continuation area
+	ceSU := concatBytes(px(0100600, 0), suspTestEntry("CE", concatBytes(bothEndian32(21), bothEndian32(100), bothEndian32(64))...))
+	copy(img[21*int(sectorSize)+100:], suspTestEntry("NM", append([]byte{0}, "continued name"...)...))
+
+	writeDir(18,
+		dirDE(string([]byte{0}), 18, rootSU),
+		dirDE(string([]byte{1}), 18, nil),
+		DirectoryEntry{ExtentLocation: 21, VolumeSequenceNumber: 1, Identifier: "CONTINUE.;1", SystemUse: ceSU},
+		DirectoryEntry{ExtentLocation: 21, VolumeSequenceNumber: 1, Identifier: "DEEP", SystemUse: concatBytes(px(0100755, 0), suspTestEntry("NM", append([]byte{0}, "deep"...)...), suspTestEntry("CL", bothEndian32(20)...))},
+		DirectoryEntry{ExtentLocation: 21, ExtentLength: 5, VolumeSequenceNumber: 1, Identifier: "LINK.;1", SystemUse: linkSU},
+		DirectoryEntry{ExtentLocation: 21, ExtentLength: 5, VolumeSequenceNumber: 1, Identifier: "MIXED_CA.GZ;1", SystemUse: fileSU},
+		dirDE("RR_MOVED", 19, px(040555, 0)),
+	)
+	writeDir(19,
+		dirDE(string([]byte{0}), 19, px(040555, 0)),
+		dirDE(string([]byte{1}), 18, nil),
+		dirDE("DEEP", 20, concatBytes(px(040700, 0), suspTestEntry("NM", append([]byte{0}, "deep"...)...), suspTestEntry("RE"))),
+	)
+	writeDir(20,
+		dirDE(string([]byte{0}), 20, px(040700, 7)),
+		dirDE(string([]byte{1}), 19, suspTestEntry("PL", bothEndian32(18)...)),
+	)
+	copy(img[21*sectorSize:], "hello")
+
+	return img
+}
+
+func TestImageReaderRockRidge(t *testing.T) {
+	data := buildRockRidgeTestImage(t)
+
+	image, err := OpenImage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.True(t, image.HasRockRidge())
+
+	root, err := image.RootDir()
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0755, root.Mode())
+
+	children, err := root.GetChildren()
+	assert.NoError(t, err)
+	names := make(map[string]*File)
+	for _, c := range children {
+		names[c.Name()] = c
+	}
+	assert.Len(t, names, 5)
+
+	if f := names["Mixed Case Name.tar.gz"]; assert.NotNil(t, f) {
+		assert.Equal(t, os.FileMode(0640), f.Mode())
+		assert.Equal(t, time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC), f.ModTime().UTC())
+		if info, ok := f.Sys().(*RockRidgeInfo); assert.True(t, ok) {
+			assert.Equal(t, uint32(1000), info.UID)
+			assert.Equal(t, uint32(1000), info.GID)
+			assert.Equal(t, uint32(1), info.Links)
+			assert.Equal(t, uint32(42), info.Inode)
+		}
+	}
+
+	if f := names["link"]; assert.NotNil(t, f) {
+		assert.Equal(t, os.ModeSymlink|0777, f.Mode())
+		assert.Equal(t, "/usr/lib/../bin", f.Sys().(*RockRidgeInfo).SymlinkTarget)
+	}
+
+	assert.NotNil(t, names["continued name"])
+
+	if f := names["deep"]; assert.NotNil(t, f) {
+		assert.True(t, f.IsDir())
+		assert.Equal(t, os.ModeDir|0700, f.Mode())
+		assert.Equal(t, uint32(7), f.Sys().(*RockRidgeInfo).UID)
+	}
+
+	if f := names["RR_MOVED"]; assert.NotNil(t, f) {
+		moved, err := f.GetChildren()
+		assert.NoError(t, err)
+		assert.Len(t, moved, 0)
+	}
+
+	// without extensions
+	image, err = OpenImage(bytes.NewReader(data), IgnoreRockRidge())
+	assert.NoError(t, err)
+	assert.False(t, image.HasRockRidge())
+	root, err = image.RootDir()
+	assert.NoError(t, err)
+	children, err = root.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 5) {
+		assert.Equal(t, "CONTINUE", children[0].Name())
+		assert.Nil(t, children[0].Sys())
+	}
+}
+
+func TestSUSPMalformedContinuation(t *testing.T) {
+	ra := bytes.NewReader(make([]byte, 4*sectorSize))
+	s := &suspContext{rockRidge: true}
+
+	for _, ce := range [][3]int32{
+		{2, 0, -1},      // negative length
+		{2, 0, 0},       // empty area
+		{2, 0, 1 << 30}, // huge length
+		{2, 2000, 100},  // crossing a sector
+		{2, -10, 20},    // negative offset
+		{-1, 0, 20},     // negative block
+	} {
+		de := &DirectoryEntry{SystemUse: suspTestEntry("CE", concatBytes(bothEndian32(ce[0]), bothEndian32(ce[1]), bothEndian32(ce[2]))...)}
+		_, err := s.readSystemUse(ra, de)
+		assert.Error(t, err, "%v", ce)
+	}
+
+	// a valid area is still read
+	de := &DirectoryEntry{SystemUse: suspTestEntry("CE", concatBytes(bothEndian32(2), bothEndian32(0), bothEndian32(20))...)}
+	_, err := s.readSystemUse(ra, de)
+	assert.NoError(t, err)
+}
+
+func TestWriterRockRidge(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+
+	mtime := time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC)
+	longTarget := "/" + strings.Repeat("a-very-long-directory-name/", 20) + "target"
+
+	assert.NoError(t, w.AddFile(strings.NewReader("#!/bin/sh\n"), "usr/bin/Some Script.sh"))
+	assert.NoError(t, w.SetAttributes("usr/bin/Some Script.sh", Attributes{Mode: 0755 | os.ModeSetuid, UID: 1000, GID: 100, ModTime: mtime}))
+	assert.NoError(t, w.SetAttributes("usr", Attributes{Mode: 0700}))
+	assert.NoError(t, w.AddSymlink("../bin/Some Script.sh", "usr/lib/script"))
+	assert.NoError(t, w.AddSymlink(longTarget, "long-link"))
+	assert.Equal(t, os.ErrNotExist, w.SetAttributes("missing", Attributes{}))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.True(t, image.HasRockRidge())
+
+	root, err := image.RootDir()
+	assert.NoError(t, err)
+	children, err := root.GetChildren()
+	assert.NoError(t, err)
+	if !assert.Len(t, children, 2) {
+		return
+	}
+
+	assert.Equal(t, "long-link", children[0].Name())
+	assert.Equal(t, os.ModeSymlink|0777, children[0].Mode())
+	assert.Equal(t, longTarget, children[0].Sys().(*RockRidgeInfo).SymlinkTarget)
+
+	usr := children[1]
+	assert.Equal(t, "usr", usr.Name())
+	assert.Equal(t, os.ModeDir|0700, usr.Mode())
+
+	usrChildren, err := usr.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, usrChildren, 2) {
+		bin, err := usrChildren[0].GetChildren()
+		assert.NoError(t, err)
+		if assert.Len(t, bin, 1) {
+			assert.Equal(t, "Some Script.sh", bin[0].Name())
+			assert.Equal(t, os.ModeSetuid|0755, bin[0].Mode())
+			assert.Equal(t, mtime, bin[0].ModTime().UTC())
+			info := bin[0].Sys().(*RockRidgeInfo)
+			assert.Equal(t, uint32(1000), info.UID)
+			assert.Equal(t, uint32(100), info.GID)
+		}
+
+		lib, err := usrChildren[1].GetChildren()
+		assert.NoError(t, err)
+		if assert.Len(t, lib, 1) {
+			assert.Equal(t, "script", lib[0].Name())
+			assert.Equal(t, "../bin/Some Script.sh", lib[0].Sys().(*RockRidgeInfo).SymlinkTarget)
+		}
+	}
+}
+
+func TestWriterRockRidgeLocalFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iso9660_rr")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0600))
+	assert.NoError(t, os.Symlink("file", filepath.Join(dir, "link")))
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+
+	// without rock ridge, links are followed
+	assert.NoError(t, w.AddLocalFile(filepath.Join(dir, "link"), "followed"))
+	assert.Equal(t, ErrRockRidgeRequired, w.AddSymlink("file", "link"))
+
+	w.RockRidge = true
+	assert.NoError(t, w.AddLocalFile(filepath.Join(dir, "file"), "file"))
+	assert.NoError(t, w.AddLocalFile(filepath.Join(dir, "link"), "link"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	root, err := image.RootDir()
+	assert.NoError(t, err)
+	children, err := root.GetChildren()
+	assert.NoError(t, err)
+	if assert.Len(t, children, 3) {
+		assert.Equal(t, "file", children[0].Name())
+		assert.Equal(t, os.FileMode(0600), children[0].Mode())
+		assert.Equal(t, "followed", children[1].Name())
+		assert.Equal(t, int64(4), children[1].Size())
+		assert.Equal(t, "link", children[2].Name())
+		assert.Equal(t, os.ModeSymlink, children[2].Mode()&os.ModeType)
+		assert.Equal(t, "file", children[2].Sys().(*RockRidgeInfo).SymlinkTarget)
+	}
+}
+
+func TestWriterRockRidgeRelocation(t *testing.T) {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	w.Strict = true
+
+	files := []string{
+		"a/b/c/d/e/f/g/h/i/j/file.txt",
+		"a/b/c/d/e/f/x/h/file.txt",
+		"a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/file.txt",
+		"a/b/c/d/e/f/g/file.txt",
+	}
+	for _, name := range files {
+		assert.NoError(t, w.AddFile(strings.NewReader(name), name))
+	}
+
+	plan, err := w.Plan()
+	assert.NoError(t, err)
+	for _, name := range files {
+		id, err := w.MangledPath(name)
+		assert.NoError(t, err)
+		if assert.Contains(t, plan.Files, id) {
+			assert.Equal(t, name, plan.Files[id].Path)
+		}
+	}
+	assert.Equal(t, "", plan.Files["RR_MOVED"].Path)
+	assert.Equal(t, "a/b/c/d/e/f/g/h", plan.Files["RR_MOVED/H"].Path)
+
+	buf := &bytes.Buffer{}
+	_, err = plan.WriteTo(buf)
+	assert.NoError(t, err)
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	for _, name := range files {
+		data, err := image.ReadFile(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, name, string(data))
+		}
+	}
+
+	h, err := image.Lookup("a/b/c/d/e/f/g/h")
+	if assert.NoError(t, err) {
+		assert.True(t, h.IsDir())
+		assert.Equal(t, "h", h.Name())
+		assert.Equal(t, uint32(3), h.Sys().(*RockRidgeInfo).Links)
+	}
+
+	// relocated directories are only listed at their original location
+	moved, err := image.Lookup("rr_moved")
+	if assert.NoError(t, err) {
+		children, err := moved.GetChildren()
+		assert.NoError(t, err)
+		assert.Empty(t, children)
+		assert.Equal(t, uint32(2), moved.Sys().(*RockRidgeInfo).Links)
+	}
+	for name, links := range map[string]uint32{"a/b/c/d/e/f/g": 3, "a/b/c/d/e/f/x": 3, "a/b/c/d/e/f": 4} {
+		f, err := image.Lookup(name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, links, f.Sys().(*RockRidgeInfo).Links, name)
+		}
+	}
+
+	// the primary hierarchy is 8 levels deep at most
+	image, err = OpenImage(bytes.NewReader(buf.Bytes()), IgnoreRockRidge())
+	assert.NoError(t, err)
+	for n, expected := range []string{"RR_MOVED/H/I/J/FILE.TXT;1", "RR_MOVED/H~01/FILE.TXT;1", "RR_MOVED/N/O/P/FILE.TXT;1", "A/B/C/D/E/F/G/FILE.TXT;1"} {
+		id, err := w.MangledPath(files[n])
+		assert.NoError(t, err)
+		assert.Equal(t, expected, id)
+		_, err = image.Lookup(strings.TrimSuffix(id, ";1"))
+		assert.NoError(t, err, id)
+	}
+}
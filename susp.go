@@ -0,0 +1,316 @@
+package iso9660
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// System Use Sharing Protocol
+// see: IEEE P1281 (SUSP 1.12)
+
+// maxContinuationAreas bounds the number of CE entries followed for a single
+// directory entry, so that looping continuation areas cannot hang the reader
+const maxContinuationAreas = 64
+
+// suspEntry is a single System Use Entry as defined in SUSP 4
+type suspEntry struct {
+	Signature string
+	Version   byte
+	Data      []byte
+}
+
+// suspContext holds the SUSP parameters of a volume, as found in the SP entry
+// of the "." record of its root directory
+type suspContext struct {
+	skip      int  // LEN_SKP: bytes to skip at the start of each System Use field
+	rockRidge bool // Rock Ridge extensions are in use
+}
+
+// parseSUSP decodes the System Use Entries found in data. If a CE entry is
+// found its contents are returned so the continuation area can be read.
+func parseSUSP(data []byte) (entries []suspEntry, ce []byte, err error) {
+	for len(data) >= 4 {
+		length := int(data[2])
+		if length < 4 || length > len(data) {
+			// padding byte at the end of the system use field, or garbage
+			if data[0] == 0 {
+				break
+			}
+			return entries, ce, errors.New("invalid SUSP entry length")
+		}
+
+		e := suspEntry{
+			Signature: string(data[0:2]),
+			Version:   data[3],
+			Data:      data[4:length],
+		}
+		data = data[length:]
+
+		switch e.Signature {
+		case "ST":
+			// terminator
+			return entries, ce, nil
+		case "CE":
+			ce = e.Data
+		case "PD":
+			// padding
+		default:
+			entries = append(entries, e)
+		}
+	}
+	return entries, ce, nil
+}
+
+// readSystemUse returns all System Use Entries of de, following continuation
+// areas as needed
+func (s *suspContext) readSystemUse(ra io.ReaderAt, de *DirectoryEntry) ([]suspEntry, error) {
+	data := de.SystemUse
+	if len(data) < s.skip {
+		return nil, nil
+	}
+	data = data[s.skip:]
+
+	var res []suspEntry
+	for i := 0; ; i++ {
+		entries, ce, err := parseSUSP(data)
+		res = append(res, entries...)
+		if err != nil || ce == nil {
+			return res, err
+		}
+		if i >= maxContinuationAreas {
+			return res, errors.New("too many SUSP continuation areas")
+		}
+
+		if len(ce) < 24 {
+			return res, io.ErrUnexpectedEOF
+		}
+		block, err := UnmarshalInt32LSBMSB(ce[0:8])
+		if err != nil {
+			return res, err
+		}
+		offset, err := UnmarshalInt32LSBMSB(ce[8:16])
+		if err != nil {
+			return res, err
+		}
+		length, err := UnmarshalInt32LSBMSB(ce[16:24])
+		if err != nil {
+			return res, err
+		}
+
+		// a continuation area never crosses a sector boundary
+		if block < 0 || offset < 0 || length <= 0 || int64(offset)+int64(length) > int64(sectorSize) {
+			return res, errors.New("invalid SUSP continuation area")
+		}
+		data = make([]byte, length)
+		if _, err = ra.ReadAt(data, int64(block)*int64(sectorSize)+int64(offset)); err != nil {
+			return res, err
+		}
+	}
+}
+
+// detectSUSP looks for a SP entry in the "." record of the given root
+// directory, and returns the matching context or nil if SUSP is not in use.
+func detectSUSP(ra io.ReaderAt, root *DirectoryEntry) (*suspContext, error) {
+	self, err := readDirSelf(ra, root.ExtentLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	// SUSP 5.3: the SP entry is at the start of the System Use field
+	su := self.SystemUse
+	if len(su) < 7 || su[0] != 'S' || su[1] != 'P' || su[2] != 7 || !bytes.Equal(su[4:6], []byte{0xbe, 0xef}) {
+		return nil, nil
+	}
+
+	s := &suspContext{}
+	entries, err := s.readSystemUse(ra, self)
+	if err != nil {
+		return nil, err
+	}
+	s.skip = int(su[6])
+
+	for _, e := range entries {
+		switch e.Signature {
+		case "ER":
+			if rripExtension(e) {
+				s.rockRidge = true
+			}
+		case "PX", "NM", "TF", "RR":
+			// some older images do not include an ER entry
+			s.rockRidge = true
+		}
+	}
+
+	return s, nil
+}
+
+// length of a CE entry
+const suspCELength = 28
+
+// encodeSUSPEntry encodes a System Use Entry
+func encodeSUSPEntry(sig string, data []byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+// encodeCE encodes a CE entry pointing to a continuation area
+func encodeCE(block, offset uint32, length int) []byte {
+	data := make([]byte, 24)
+	WriteInt32LSBMSB(data[0:8], int32(block))
+	WriteInt32LSBMSB(data[8:16], int32(offset))
+	WriteInt32LSBMSB(data[16:24], int32(length))
+	return encodeSUSPEntry("CE", data)
+}
+
+// suspRecordSpace returns the room left for System Use entries in a directory
+// record with an identifier of the given length, keeping the record length
+// even
+func suspRecordSpace(identifierLen int) int {
+	return 254 - (33 + identifierLen + (identifierLen+1)%2)
+}
+
+// splitSUSP splits entries between those stored in a System Use field of the
+// given size, and those that overflow to continuation areas. If there is an
+// overflow, room is left in the field for a CE entry.
+func splitSUSP(entries [][]byte, space int) (inField, overflow [][]byte) {
+	var total int
+	for _, e := range entries {
+		total += len(e)
+	}
+	if total <= space {
+		return entries, nil
+	}
+
+	space -= suspCELength
+	for i, e := range entries {
+		if len(e) > space {
+			return entries[:i], entries[i:]
+		}
+		space -= len(e)
+	}
+	return entries, nil
+}
+
+// systemUseLength returns the length of a record's System Use field holding
+// the given entries, including any CE entry and padding
+func systemUseLength(entries [][]byte, identifierLen int) int {
+	inField, overflow := splitSUSP(entries, suspRecordSpace(identifierLen))
+	var l int
+	for _, e := range inField {
+		l += len(e)
+	}
+	if overflow != nil {
+		l += suspCELength
+	}
+	return l + l%2
+}
+
+// continuationBuffer accumulates the continuation areas of a directory's
+// records. Areas never cross a sector boundary.
+type continuationBuffer struct {
+	data []byte
+}
+
+// place reserves an area of the given size and returns its offset
+func (c *continuationBuffer) place(size int) int {
+	if used := len(c.data) % int(sectorSize); used != 0 && used+size > int(sectorSize) {
+		c.data = append(c.data, make([]byte, int(sectorSize)-used)...)
+	}
+	offset := len(c.data)
+	c.data = append(c.data, make([]byte, size)...)
+	return offset
+}
+
+// suspContinuation holds the continuation areas of a single record
+type suspContinuation struct {
+	inField [][]byte
+	areas   [][][]byte
+	offsets []int
+}
+
+// continuationAreas splits entries that do not fit in a record into a chain of
+// continuation areas, each fitting in a sector
+func continuationAreas(entries [][]byte) [][][]byte {
+	var areas [][][]byte
+	for len(entries) > 0 {
+		area, rest := splitSUSP(entries, int(sectorSize))
+		areas = append(areas, area)
+		entries = rest
+	}
+	return areas
+}
+
+// systemUseFields returns the System Use field of each record of dir, indexed
+// by identifier. Entries which do not fit in their record are moved to
+// continuation areas, which are allocated right away.
+func (wc *writeContext) systemUseFields(dir *itemDir) map[string][]byte {
+	if dir.su == nil {
+		return nil
+	}
+	wc.resolveLinks(dir)
+
+	names := append([]string{string([]byte{0}), string([]byte{1})}, dir.sortedNames()...)
+	conts := make(map[string]*suspContinuation)
+	buf := &continuationBuffer{}
+
+	for _, name := range names {
+		inField, overflow := splitSUSP(dir.su[name], suspRecordSpace(len(name)))
+		c := &suspContinuation{inField: inField}
+		if overflow != nil {
+			c.areas = continuationAreas(overflow)
+			for i, area := range c.areas {
+				size := suspCELength
+				if i == len(c.areas)-1 {
+					size = 0
+				}
+				for _, e := range area {
+					size += len(e)
+				}
+				c.offsets = append(c.offsets, buf.place(size))
+			}
+		}
+		conts[name] = c
+	}
+
+	var start uint32
+	if len(buf.data) > 0 {
+		start = wc.allocMetadata(&bufferHndlr{d: buf.data})
+	}
+	location := func(offset int) (uint32, uint32) {
+		return start + uint32(offset)/sectorSize, uint32(offset) % sectorSize
+	}
+
+	res := make(map[string][]byte, len(names))
+	for _, name := range names {
+		c := conts[name]
+		field := bytes.Join(c.inField, nil)
+
+		for i, area := range c.areas {
+			data := bytes.Join(area, nil)
+			if i == 0 {
+				block, offset := location(c.offsets[0])
+				field = append(field, encodeCE(block, offset, len(data)+ceLengthIfChained(i, c))...)
+			}
+			if i < len(c.areas)-1 {
+				next := bytes.Join(c.areas[i+1], nil)
+				block, offset := location(c.offsets[i+1])
+				data = append(data, encodeCE(block, offset, len(next)+ceLengthIfChained(i+1, c))...)
+			}
+			copy(buf.data[c.offsets[i]:], data)
+		}
+
+		if len(field)%2 != 0 {
+			field = append(field, 0)
+		}
+		res[name] = field
+	}
+	return res
+}
+
+// ceLengthIfChained returns the length of the CE entry ending area i, if any
+func ceLengthIfChained(i int, c *suspContinuation) int {
+	if i < len(c.areas)-1 {
+		return suspCELength
+	}
+	return 0
+}
@@ -0,0 +1,544 @@
+package iso9660
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	mbrBootCodeSize     = 432 // boot code, followed by the boot image location
+	mbrPartitionTable   = 446
+	mbrBlockSize        = 512
+	mbrBlocksPerSector  = 4    // 512-byte blocks per 2048-byte sector
+	isoHybridPartition  = 0x17 // type used by isohybrid
+	isoHybridAlignment  = 512  // sectors of a MiB, isohybrid partitions are rounded up to
+	mbrPartitionProtect = 0xee // protective partition of GPT disks
+	mbrPartitionEFI     = 0xef
+
+	gptHeaderSize     = 92
+	gptEntrySize      = 128
+	gptEntryCount     = 128
+	gptEntriesBlocks  = gptEntrySize * gptEntryCount / mbrBlockSize
+	gptBackupBlocks   = gptEntriesBlocks + 1 // backup entries and header
+	gptBackupSectors  = (gptBackupBlocks + mbrBlocksPerSector - 1) / mbrBlocksPerSector
+	gptPrimaryEntries = 2 // block of the primary partition entries
+
+	apmBlockSize  = 2048
+	apmMaxEntries = systemAreaSize/apmBlockSize - 1 - gptEntriesBlocks/mbrBlocksPerSector
+	apmFlags      = 0x33       // valid, allocated, readable, writable
+	apmMockBlocks = 0x00009090 // block count of Block0, harmless as x86 code
+)
+
+// GPT partition type GUIDs, in on-disk byte order
+var (
+	gptTypeEFI       = [16]byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b}
+	gptTypeBasicData = [16]byte{0xa2, 0xa0, 0xd0, 0xeb, 0xe5, 0xb9, 0x33, 0x44, 0x87, 0xc0, 0x68, 0xb6, 0xb7, 0x26, 0x99, 0xc7}
+	gptTypeHFSPlus   = [16]byte{0x00, 0x53, 0x46, 0x48, 0x00, 0x00, 0xaa, 0x11, 0xaa, 0x11, 0x00, 0x30, 0x65, 0x43, 0xec, 0xac}
+)
+
+// ErrSystemAreaTooLarge is returned when writing an image whose SystemArea is
+// larger than the 16 sectors of system area
+var ErrSystemAreaTooLarge = errors.New("system area is larger than 16 sectors")
+
+// ErrNoBootImage is returned when writing an isohybrid MBR for an image that
+// has no bootable El Torito entry for the x86 platform
+var ErrNoBootImage = errors.New("no x86 boot image to load from the MBR")
+
+// IsoHybrid describes an isohybrid MBR, written in the system area so that
+// images also boot when copied to USB sticks or other media seen as hard
+// disks. The boot code, typically syslinux's isohdpfx.bin, loads the first
+// bootable El Torito image of the x86 platform, whose location is patched in.
+// The partition covering the image is rounded up to a full MiB, and the
+// image is padded accordingly.
+type IsoHybrid struct {
+	BootCode        []byte // MBR boot code, up to 432 bytes
+	PartitionType   byte   // type of the partition covering the image, 0x17 if not set
+	DiskSignature   uint32 // disk signature of the MBR
+	PartitionOffset uint32 // start of the partition in 512-byte blocks
+}
+
+// validate checks the options
+func (h *IsoHybrid) validate() error {
+	if len(h.BootCode) > mbrBootCodeSize {
+		return fmt.Errorf("isohybrid boot code is %d bytes long, the maximum is %d", len(h.BootCode), mbrBootCodeSize)
+	}
+	return nil
+}
+
+// GPT describes a GUID partition table, written in the system area with a
+// backup at the end of the image, so that images boot from USB sticks on UEFI
+// systems. Its EFI system partition covers the first El Torito boot image of
+// the EFI platform, which must be a FAT image. The HFS+ image of APM, if any,
+// gets its own partition.
+//
+// The MBR of the image becomes a protective MBR, which keeps the boot code of
+// IsoHybrid if set.
+type GPT struct {
+	// DiskGUID is the GUID of the disk in on-disk byte order, random if not
+	// set, or derived from the image metadata if it is reproducible: names,
+	// sizes, dates and layout of files, but not their contents. Partition
+	// GUIDs are derived from it.
+	DiskGUID [16]byte
+}
+
+// APM describes an Apple Partition Map with 2048-byte blocks, written in the
+// system area so that Intel Macs can boot images from USB sticks. Its
+// partitions cover the first El Torito boot image of the EFI platform and the
+// HFS+ image, if any.
+//
+// Block0 of the map overwrites the first 8 bytes of the MBR, the boot code of
+// IsoHybrid must allow for it, as the isohdpfx.bin templates of syslinux do.
+// GPT entries are moved after the last block of the map.
+type APM struct {
+	// HFSPlus is an optional HFS+ filesystem image, such as a Mac boot
+	// image, stored after the files of the image
+	HFSPlus Item
+}
+
+// partition is a partition of the image, described in the partition tables
+// of the system area
+type partition struct {
+	name    string
+	mbrType byte
+	gptType [16]byte
+	apmType string
+	start   uint32 // in 2048-byte sectors
+	size    int64  // in bytes
+}
+
+// blocks returns the first and last 512-byte blocks of the partition
+func (p *partition) blocks() (first, last uint64) {
+	first = uint64(p.start) * mbrBlocksPerSector
+	count := (uint64(p.size) + mbrBlockSize - 1) / mbrBlockSize
+	if count == 0 {
+		count = 1
+	}
+	return first, first + count - 1
+}
+
+// appendedPartition is a partition image stored after the data of the image,
+// see AppendPartition
+type appendedPartition struct {
+	item  Item
+	pType byte
+}
+
+// AppendPartition adds a partition image, stored after the data of the image
+// and described in the partition tables of the system area. pType is the
+// type of its MBR partition entry. Partitions of type 0xef are EFI system
+// partitions in GPT and basic data partitions otherwise.
+//
+// Appended partitions are listed in the MBR partition table unless GPT is
+// used, which leaves room for 3 partitions along with IsoHybrid.
+func (iw *ImageWriter) AppendPartition(data Item, pType byte) error {
+	if pType == 0 {
+		return errors.New("appended partitions can't be of the empty type")
+	}
+	item, err := NewItemReader(data)
+	if err != nil {
+		return err
+	}
+
+	iw.appended = append(iw.appended, &appendedPartition{item: item, pType: pType})
+	return nil
+}
+
+// partitions returns the partitions to be described in the partition tables
+// of the system area
+func (wc *writeContext) partitions() []*partition {
+	var res []*partition
+	for _, b := range wc.boot {
+		if b.Platform == ElToritoEFI {
+			res = append(res, &partition{
+				name:    "EFI System Partition",
+				mbrType: mbrPartitionEFI,
+				gptType: gptTypeEFI,
+				apmType: "Apple_HFS", // as expected by Mac firmwares
+				start:   b.file.meta().targetSector,
+				size:    b.file.Size(),
+			})
+			break
+		}
+	}
+	if a := wc.iw.APM; a != nil && a.HFSPlus != nil {
+		res = append(res, &partition{
+			name:    "HFS+ Boot Image",
+			gptType: gptTypeHFSPlus,
+			apmType: "Apple_HFS",
+			start:   wc.render(a.HFSPlus).meta().targetSector,
+			size:    a.HFSPlus.Size(),
+		})
+	}
+	return append(res, wc.appendedPartitions()...)
+}
+
+// appendedPartitions returns the partitions added with AppendPartition
+func (wc *writeContext) appendedPartitions() []*partition {
+	var res []*partition
+	for n, a := range wc.iw.appended {
+		p := &partition{
+			name:    fmt.Sprintf("Appended%d", n+1),
+			mbrType: a.pType,
+			gptType: gptTypeBasicData,
+			apmType: "Data",
+			start:   wc.render(a.item).meta().targetSector,
+			size:    a.item.Size(),
+		}
+		if a.pType == mbrPartitionEFI {
+			p.gptType, p.apmType = gptTypeEFI, "Apple_HFS"
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+// write writes Block0 and the partition map entries in the system area, in
+// 2048-byte blocks. bootCode tells whether Block0 must be harmless x86 code.
+func (a *APM) write(area []byte, parts []*partition, total uint32, bootCode bool) error {
+	if len(parts) == 0 {
+		return errors.New("no partition to describe in APM")
+	}
+	entries := uint32(len(parts) + 1)
+	if entries > apmMaxEntries {
+		return errors.New("too many partitions for APM")
+	}
+
+	// Block0
+	copy(area[0:2], "ER")
+	binary.BigEndian.PutUint16(area[2:4], apmBlockSize)
+	if bootCode {
+		binary.BigEndian.PutUint32(area[4:8], apmMockBlocks)
+	} else {
+		binary.BigEndian.PutUint32(area[4:8], total)
+	}
+
+	entry := func(n int, name, pType string, start, count uint32, flags uint32) {
+		data := area[(n+1)*apmBlockSize : (n+2)*apmBlockSize]
+		copy(data[0:2], "PM")
+		binary.BigEndian.PutUint32(data[4:8], entries)
+		binary.BigEndian.PutUint32(data[8:12], start)
+		binary.BigEndian.PutUint32(data[12:16], count)
+		copy(data[16:47], name)
+		copy(data[48:79], pType)
+		binary.BigEndian.PutUint32(data[84:88], count) // logical blocks
+		binary.BigEndian.PutUint32(data[88:92], flags)
+	}
+
+	// the first entry describes the map itself
+	entry(0, "Apple", "Apple_partition_map", 1, entries, 3)
+	for n, p := range parts {
+		count := uint32((p.size + apmBlockSize - 1) / apmBlockSize)
+		entry(n+1, p.name, p.apmType, p.start, count, apmFlags)
+	}
+	return nil
+}
+
+// partitionGUID returns the GUID of the nth partition of the disk, derived
+// from the disk GUID
+func partitionGUID(disk [16]byte, n int) [16]byte {
+	var res [16]byte
+	h := sha1.Sum(append(disk[:], byte(n>>8), byte(n)))
+	copy(res[:], h[:])
+	// random UUID: version 4, RFC 4122 variant
+	res[7] = res[7]&0x0f | 0x40
+	res[8] = res[8]&0x3f | 0x80
+	return res
+}
+
+// diskGUID returns the GUID of the disk described by g: the one set, one
+// derived from the metadata of reproducible images, or a random one. The
+// metadata is made of the volume descriptors, directory records, path
+// tables, continuation areas and extended attribute records, so the GUID
+// depends on the names, sizes, locations and attributes of files but not on
+// their contents.
+func (wc *writeContext) diskGUID(g *GPT) ([16]byte, error) {
+	disk := g.DiskGUID
+	switch {
+	case disk != [16]byte{}:
+	case wc.iw.Reproducible:
+		h := sha1.New()
+		for _, vd := range wc.vd {
+			data, err := vd.MarshalBinary()
+			if err != nil {
+				return disk, err
+			}
+			h.Write(data)
+		}
+		for _, it := range wc.metadata {
+			switch v := it.(type) {
+			case *itemDir:
+				h.Write(v.buf.Bytes())
+			case *bufferHndlr:
+				h.Write(v.d)
+			}
+		}
+		copy(disk[:], h.Sum(nil))
+		// random UUID: version 4, RFC 4122 variant
+		disk[7] = disk[7]&0x0f | 0x40
+		disk[8] = disk[8]&0x3f | 0x80
+	default:
+		if _, err := rand.Read(disk[:]); err != nil {
+			return disk, err
+		}
+	}
+	return disk, nil
+}
+
+// write writes the GPT header in the system area with its entries at the
+// given block, and their backup in the last blocks of backup, which ends the
+// disk of the given number of blocks
+func (g *GPT) write(area, backup []byte, disk [16]byte, parts []*partition, entriesStart, blocks uint64) error {
+	if len(parts) == 0 {
+		return errors.New("no partition to describe in GPT")
+	}
+	if len(parts) > gptEntryCount {
+		return errors.New("too many partitions for GPT")
+	}
+
+	entries := make([]byte, gptEntrySize*gptEntryCount)
+	for n, p := range parts {
+		entry := entries[n*gptEntrySize : (n+1)*gptEntrySize]
+		guid := partitionGUID(disk, n)
+		first, last := p.blocks()
+		copy(entry[0:16], p.gptType[:])
+		copy(entry[16:32], guid[:])
+		binary.LittleEndian.PutUint64(entry[32:40], first)
+		binary.LittleEndian.PutUint64(entry[40:48], last)
+		for i, c := range utf16.Encode([]rune(p.name)) {
+			if 56+2*i+2 > gptEntrySize {
+				break
+			}
+			binary.LittleEndian.PutUint16(entry[56+2*i:], c)
+		}
+	}
+
+	backupEntries := blocks - gptBackupBlocks
+	header := func(current, other, entriesLBA uint64) []byte {
+		data := make([]byte, mbrBlockSize)
+		copy(data[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(data[8:12], 0x00010000) // revision 1.0
+		binary.LittleEndian.PutUint32(data[12:16], gptHeaderSize)
+		binary.LittleEndian.PutUint64(data[24:32], current)
+		binary.LittleEndian.PutUint64(data[32:40], other)
+		binary.LittleEndian.PutUint64(data[40:48], entriesStart+gptEntriesBlocks) // first usable
+		binary.LittleEndian.PutUint64(data[48:56], backupEntries-1)               // last usable
+		copy(data[56:72], disk[:])
+		binary.LittleEndian.PutUint64(data[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(data[80:84], gptEntryCount)
+		binary.LittleEndian.PutUint32(data[84:88], gptEntrySize)
+		binary.LittleEndian.PutUint32(data[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(data[16:20], crc32.ChecksumIEEE(data[:gptHeaderSize]))
+		return data
+	}
+
+	// primary GPT
+	copy(area[mbrBlockSize:], header(1, blocks-1, entriesStart))
+	copy(area[entriesStart*mbrBlockSize:], entries)
+
+	// backup GPT, ending the disk
+	end := len(backup)
+	copy(backup[end-mbrBlockSize:], header(blocks-1, 1, backupEntries))
+	copy(backup[end-gptBackupBlocks*mbrBlockSize:], entries)
+	return nil
+}
+
+// mbrPartition is an entry of a MBR partition table
+type mbrPartition struct {
+	bootable bool
+	pType    byte
+	start    uint32 // in 512-byte blocks
+	size     uint32 // in 512-byte blocks
+}
+
+// mbrGeometry returns the number of heads per cylinder and sectors per head
+// used to compute C/H/S addresses of a disk of the given number of blocks
+func mbrGeometry(blocks int64) (heads, sectors uint32) {
+	if blocks <= 1<<30/mbrBlockSize {
+		return 64, 32
+	}
+	return 252, 63
+}
+
+// chsAddress returns the C/H/S address of the given block, as stored in MBR
+// partition tables
+func chsAddress(lba uint32, heads, sectors uint32) []byte {
+	c := lba / (heads * sectors)
+	h := (lba / sectors) % heads
+	s := lba%sectors + 1
+	if c > 1023 {
+		// out of C/H/S range
+		c, h, s = 1023, heads-1, sectors
+	}
+	return []byte{byte(h), byte(s) | byte(c>>2)&0xc0, byte(c)}
+}
+
+// marshal encodes the partition entry in data, for a disk of the given
+// number of blocks
+func (p *mbrPartition) marshal(data []byte, blocks int64) {
+	heads, sectors := mbrGeometry(blocks)
+	if p.bootable {
+		data[0] = 0x80
+	}
+	copy(data[1:4], chsAddress(p.start, heads, sectors))
+	data[4] = p.pType
+	copy(data[5:8], chsAddress(p.start+p.size-1, heads, sectors))
+	binary.LittleEndian.PutUint32(data[8:12], p.start)
+	binary.LittleEndian.PutUint32(data[12:16], p.size)
+}
+
+// mbrBlocks returns the number of 512-byte blocks covering the given number
+// of 2048-byte sectors, capped to what MBR partition tables can describe
+func mbrBlocks(sectors uint32) uint32 {
+	blocks := int64(sectors) * int64(mbrBlocksPerSector)
+	if blocks > 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(blocks)
+}
+
+// writeMBR writes the MBR boot code, disk signature and partition table to
+// the start of the system area, keeping the bytes of the system area that are
+// not set
+func writeMBR(area []byte, bootCode []byte, signature uint32, parts []*mbrPartition, blocks int64) error {
+	if len(parts) > 4 {
+		return errors.New("too many partitions for a MBR partition table")
+	}
+
+	copy(area[:mbrBootCodeSize], bootCode)
+	if signature != 0 {
+		binary.LittleEndian.PutUint32(area[440:444], signature)
+	}
+	for n, p := range parts {
+		p.marshal(area[mbrPartitionTable+16*n:mbrPartitionTable+16*(n+1)], blocks)
+	}
+	area[510], area[511] = 0x55, 0xaa
+	return nil
+}
+
+// padIsoHybrid pads the image so that its isohybrid partition ends on a full
+// MiB, as expected by partitioning tools. The partition ends before appended
+// partitions, or else with the image, after the backup GPT if any.
+func (wc *writeContext) padIsoHybrid() {
+	end := wc.freeSectorPointer
+	if len(wc.iw.appended) == 0 && wc.iw.GPT != nil {
+		end += gptBackupSectors
+	}
+	if n := end % isoHybridAlignment; n != 0 {
+		wc.allocSectors(&bufferHndlr{d: make([]byte, (isoHybridAlignment-n)*sectorSize)})
+	}
+}
+
+// isoHybridBootImage returns the El Torito entry loaded by isohybrid MBRs
+func (wc *writeContext) isoHybridBootImage() (*BootCatalogEntry, error) {
+	for _, b := range wc.boot {
+		if b.Platform == ElToritoX86 && !b.NotBootable {
+			return b, nil
+		}
+	}
+	return nil, ErrNoBootImage
+}
+
+// systemArea returns the contents of the 16 sectors of system area, once
+// all items have been allocated: the SystemArea of the image with partition
+// tables written on top of it. It also fills the backup GPT, if any.
+func (wc *writeContext) systemArea() ([]byte, error) {
+	area := make([]byte, systemAreaSize)
+	total := wc.freeSectorPointer
+	blocks := int64(total) * int64(mbrBlocksPerSector)
+
+	if wc.iw.SystemArea != nil {
+		sa := wc.render(wc.iw.SystemArea)
+		if sa.Size() > int64(len(area)) {
+			return nil, ErrSystemAreaTooLarge
+		}
+		_, err := io.ReadFull(sa, area[:sa.Size()])
+		sa.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// appended partitions, listed in the MBR after the isohybrid partition
+	var appended []*mbrPartition
+	for _, p := range wc.appendedPartitions() {
+		first, last := p.blocks()
+		appended = append(appended, &mbrPartition{pType: p.mbrType, start: uint32(first), size: uint32(last - first + 1)})
+	}
+
+	var (
+		bootCode  []byte
+		signature uint32
+		mbrParts  []*mbrPartition
+	)
+
+	if h := wc.iw.IsoHybrid; h != nil {
+		if err := h.validate(); err != nil {
+			return nil, err
+		}
+		bootCode, signature = h.BootCode, h.DiskSignature
+
+		pType := h.PartitionType
+		if pType == 0 {
+			pType = isoHybridPartition
+		}
+		// the partition covers the image up to the appended partitions
+		end := mbrBlocks(total)
+		if len(appended) > 0 {
+			end = appended[0].start
+		}
+		if h.PartitionOffset >= end {
+			return nil, errors.New("isohybrid partition offset is beyond the end of the image")
+		}
+		mbrParts = []*mbrPartition{{bootable: true, pType: pType, start: h.PartitionOffset, size: end - h.PartitionOffset}}
+	}
+	mbrParts = append(mbrParts, appended...)
+
+	// GPT entries follow the APM entries
+	gptEntries := uint64(gptPrimaryEntries)
+	if wc.iw.APM != nil {
+		gptEntries = uint64(len(wc.partitions())+2) * apmBlockSize / mbrBlockSize
+	}
+
+	if g := wc.iw.GPT; g != nil {
+		disk, err := wc.diskGUID(g)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.write(area, wc.gptBackup.d, disk, wc.partitions(), gptEntries, uint64(blocks)); err != nil {
+			return nil, err
+		}
+
+		// protective MBR, covering the whole disk
+		mbrParts = []*mbrPartition{{pType: mbrPartitionProtect, start: 1, size: mbrBlocks(total) - 1}}
+	}
+
+	if mbrParts != nil {
+		if err := writeMBR(area, bootCode, signature, mbrParts, blocks); err != nil {
+			return nil, err
+		}
+	}
+
+	if a := wc.iw.APM; a != nil {
+		// Block0 overwrites the start of the MBR boot code
+		if err := a.write(area, wc.partitions(), total, bootCode != nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if wc.iw.IsoHybrid != nil {
+		boot, err := wc.isoHybridBootImage()
+		if err != nil {
+			return nil, err
+		}
+		// 64-bit location of the boot image, loaded by the boot code
+		binary.LittleEndian.PutUint64(area[mbrBootCodeSize:mbrBootCodeSize+8], uint64(boot.file.meta().targetSector)*mbrBlocksPerSector)
+	}
+
+	return area, nil
+}
@@ -0,0 +1,320 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestImage writes w and returns the image data along with the image
+func writeTestImage(t *testing.T, w *ImageWriter) ([]byte, *Image) {
+	buf := &bytes.Buffer{}
+	if !assert.NoError(t, w.WriteTo(buf)) {
+		return nil, nil
+	}
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	return buf.Bytes(), image
+}
+
+// newBootTestWriter returns a writer with a x86 boot image
+func newBootTestWriter(t *testing.T) *ImageWriter {
+	w, err := NewWriter()
+	assert.NoError(t, err)
+
+	item, err := NewItemReader(bytes.NewReader(make([]byte, 4096)))
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{BootInfoTable: true}, item, "isolinux/isolinux.bin"))
+	return w
+}
+
+func TestWriterIsoHybrid(t *testing.T) {
+	bootCode := bytes.Repeat([]byte{0x90}, mbrBootCodeSize)
+
+	for _, offset := range []uint32{0, 64} {
+		w := newBootTestWriter(t)
+		w.IsoHybrid = &IsoHybrid{BootCode: bootCode, DiskSignature: 0x12345678, PartitionOffset: offset}
+
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		boot, err := image.Lookup("isolinux/isolinux.bin")
+		assert.NoError(t, err)
+
+		assert.Equal(t, bootCode, data[:mbrBootCodeSize])
+		assert.Equal(t, uint32(boot.de.ExtentLocation)*4, binary.LittleEndian.Uint32(data[432:436]))
+		assert.Equal(t, uint32(0x12345678), binary.LittleEndian.Uint32(data[440:444]))
+		assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+
+		part := data[446:462]
+		assert.Equal(t, byte(0x80), part[0])
+		assert.Equal(t, byte(isoHybridPartition), part[4])
+		assert.Equal(t, offset, binary.LittleEndian.Uint32(part[8:12]))
+		assert.Equal(t, uint32(len(data)/512)-offset, binary.LittleEndian.Uint32(part[12:16]))
+		assert.Zero(t, len(data)%(1<<20), "image padded to a full MiB")
+		if offset == 0 {
+			// C/H/S address of the first block
+			assert.Equal(t, []byte{0, 1, 0}, part[1:4])
+		}
+		assert.Equal(t, make([]byte, 48), data[462:510])
+
+		// the image is still readable
+		assert.Equal(t, int32(len(data)/int(sectorSize)), image.primaryVolume().VolumeSpaceSize)
+		_, err = image.BootCatalog()
+		assert.NoError(t, err)
+	}
+
+	// a boot image is needed
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.IsoHybrid = &IsoHybrid{BootCode: bootCode}
+	assert.Equal(t, ErrNoBootImage, w.WriteTo(&bytes.Buffer{}))
+
+	w = newBootTestWriter(t)
+	w.IsoHybrid = &IsoHybrid{BootCode: make([]byte, 440)}
+	assert.Error(t, w.WriteTo(&bytes.Buffer{}))
+}
+
+// checkGPTHeader verifies the CRCs of a GPT header of image, and
+// returns its entries
+func checkGPTHeader(t *testing.T, image, header []byte) []byte {
+	assert.Equal(t, "EFI PART", string(header[:8]))
+
+	crc := binary.LittleEndian.Uint32(header[16:20])
+	check := append([]byte(nil), header[:gptHeaderSize]...)
+	binary.LittleEndian.PutUint32(check[16:20], 0)
+	assert.Equal(t, crc32.ChecksumIEEE(check), crc)
+
+	start := binary.LittleEndian.Uint64(header[72:80]) * 512
+	entries := image[start : start+gptEntrySize*gptEntryCount]
+	assert.Equal(t, crc32.ChecksumIEEE(entries), binary.LittleEndian.Uint32(header[88:92]))
+	return entries
+}
+
+func TestWriterGPT(t *testing.T) {
+	guid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	for _, hybrid := range []bool{false, true} {
+		w := newBootTestWriter(t)
+		efi, err := NewItemReader(bytes.NewReader(make([]byte, 5000)))
+		assert.NoError(t, err)
+		assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{Platform: ElToritoEFI}, efi, "efi.img"))
+		w.GPT = &GPT{DiskGUID: guid}
+		if hybrid {
+			w.IsoHybrid = &IsoHybrid{BootCode: []byte{0xfa, 0xeb}}
+		}
+
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		blocks := uint64(len(data) / 512)
+		assert.Equal(t, int32(len(data)/int(sectorSize)), image.primaryVolume().VolumeSpaceSize)
+
+		// protective MBR, not marked active
+		part := data[446:462]
+		assert.Equal(t, byte(0), part[0])
+		if hybrid {
+			assert.Zero(t, len(data)%(1<<20), "image padded to a full MiB")
+		}
+		assert.Equal(t, byte(0xee), part[4])
+		assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(part[8:12]))
+		assert.Equal(t, uint32(blocks-1), binary.LittleEndian.Uint32(part[12:16]))
+		assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+		if hybrid {
+			assert.Equal(t, []byte{0xfa, 0xeb}, data[:2])
+			assert.NotZero(t, binary.LittleEndian.Uint32(data[432:436]))
+		}
+
+		primary := data[512:1024]
+		entries := checkGPTHeader(t, data, primary)
+		assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(primary[24:32]))
+		assert.Equal(t, blocks-1, binary.LittleEndian.Uint64(primary[32:40]))
+		assert.Equal(t, uint64(34), binary.LittleEndian.Uint64(primary[40:48]))
+		assert.Equal(t, blocks-34, binary.LittleEndian.Uint64(primary[48:56]))
+		assert.Equal(t, guid[:], primary[56:72])
+
+		backup := data[len(data)-512:]
+		assert.Equal(t, entries, checkGPTHeader(t, data, backup))
+		assert.Equal(t, blocks-1, binary.LittleEndian.Uint64(backup[24:32]))
+		assert.Equal(t, uint64(1), binary.LittleEndian.Uint64(backup[32:40]))
+		assert.Equal(t, blocks-33, binary.LittleEndian.Uint64(backup[72:80]))
+
+		// EFI system partition
+		f, err := image.Lookup("efi.img")
+		assert.NoError(t, err)
+		assert.Equal(t, gptTypeEFI[:], entries[0:16])
+		assert.Equal(t, uint64(f.de.ExtentLocation)*4, binary.LittleEndian.Uint64(entries[32:40]))
+		assert.Equal(t, uint64(f.de.ExtentLocation)*4+9, binary.LittleEndian.Uint64(entries[40:48]))
+		assert.Equal(t, make([]byte, gptEntrySize), entries[gptEntrySize:2*gptEntrySize])
+	}
+
+	// the EFI system partition needs an EFI boot image
+	w := newBootTestWriter(t)
+	w.GPT = &GPT{}
+	assert.Error(t, w.WriteTo(&bytes.Buffer{}))
+}
+
+func TestWriterAPM(t *testing.T) {
+	hfs := bytes.Repeat([]byte("H+"), 3000)
+
+	for _, hybrid := range []bool{false, true} {
+		w := newBootTestWriter(t)
+		efi, err := NewItemReader(bytes.NewReader(make([]byte, 5000)))
+		assert.NoError(t, err)
+		assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{Platform: ElToritoEFI}, efi, "efi.img"))
+		item, err := NewItemReader(bytes.NewReader(hfs))
+		assert.NoError(t, err)
+		w.APM = &APM{HFSPlus: item}
+		if hybrid {
+			w.IsoHybrid = &IsoHybrid{BootCode: bytes.Repeat([]byte{0x90}, 32)}
+			w.GPT = &GPT{}
+		}
+
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+
+		// Block0
+		assert.Equal(t, "ER", string(data[0:2]))
+		assert.Equal(t, uint16(2048), binary.BigEndian.Uint16(data[2:4]))
+		if hybrid {
+			assert.Equal(t, uint32(0x9090), binary.BigEndian.Uint32(data[4:8]))
+			assert.Equal(t, bytes.Repeat([]byte{0x90}, 24), data[8:32])
+			assert.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+		} else {
+			assert.Equal(t, uint32(image.primaryVolume().VolumeSpaceSize), binary.BigEndian.Uint32(data[4:8]))
+			assert.Equal(t, make([]byte, 2), data[510:512])
+		}
+
+		efiFile, err := image.Lookup("efi.img")
+		assert.NoError(t, err)
+		hfsStart := uint32(bytes.Index(data, hfs) / 2048)
+		assert.Equal(t, hfs, data[hfsStart*2048:hfsStart*2048+uint32(len(hfs))])
+
+		for n, expected := range []struct {
+			name, pType  string
+			start, count uint32
+		}{
+			{"Apple", "Apple_partition_map", 1, 3},
+			{"EFI System Partition", "Apple_HFS", uint32(efiFile.de.ExtentLocation), 3},
+			{"HFS+ Boot Image", "Apple_HFS", hfsStart, 3},
+		} {
+			entry := data[(n+1)*2048 : (n+2)*2048]
+			assert.Equal(t, "PM", string(entry[0:2]))
+			assert.Equal(t, uint32(3), binary.BigEndian.Uint32(entry[4:8]))
+			assert.Equal(t, expected.start, binary.BigEndian.Uint32(entry[8:12]))
+			assert.Equal(t, expected.count, binary.BigEndian.Uint32(entry[12:16]))
+			assert.Equal(t, expected.name, string(bytes.TrimRight(entry[16:48], "\x00")))
+			assert.Equal(t, expected.pType, string(bytes.TrimRight(entry[48:80], "\x00")))
+			assert.Equal(t, expected.count, binary.BigEndian.Uint32(entry[84:88]))
+		}
+		if !hybrid {
+			assert.Equal(t, make([]byte, 2048), data[4*2048:5*2048])
+		} else {
+			// GPT entries follow the partition map
+			entries := checkGPTHeader(t, data, data[512:1024])
+			assert.Equal(t, uint64(16), binary.LittleEndian.Uint64(data[512+72:512+80]))
+			assert.Equal(t, uint64(48), binary.LittleEndian.Uint64(data[512+40:512+48]))
+			assert.Equal(t, gptTypeEFI[:], entries[0:16])
+			assert.Equal(t, gptTypeHFSPlus[:], entries[gptEntrySize:gptEntrySize+16])
+			assert.Equal(t, uint64(hfsStart)*4, binary.LittleEndian.Uint64(entries[gptEntrySize+32:]))
+		}
+	}
+
+	// there must be a partition to describe
+	w := newBootTestWriter(t)
+	w.APM = &APM{}
+	assert.Error(t, w.WriteTo(&bytes.Buffer{}))
+}
+
+func TestWriterSystemArea(t *testing.T) {
+	label := bytes.Repeat([]byte{0x5a}, int(systemAreaSize))
+	parts := [][]byte{bytes.Repeat([]byte("ext4"), 2500), bytes.Repeat([]byte("FAT"), 1000)}
+
+	for _, hybrid := range []bool{false, true} {
+		w := newBootTestWriter(t)
+		assert.NoError(t, w.AddFile(bytes.NewReader(make([]byte, 10000)), "data.bin"))
+		sa, err := NewItemReader(bytes.NewReader(label))
+		assert.NoError(t, err)
+		w.SystemArea = sa
+		if hybrid {
+			w.IsoHybrid = &IsoHybrid{BootCode: []byte{0xfa}}
+		}
+		for n, pType := range []byte{0x83, mbrPartitionEFI} {
+			item, err := NewItemReader(bytes.NewReader(parts[n]))
+			assert.NoError(t, err)
+			assert.NoError(t, w.AppendPartition(item, pType))
+		}
+
+		data, image := writeTestImage(t, w)
+		if image == nil {
+			return
+		}
+		assert.Equal(t, int32(len(data)/int(sectorSize)), image.primaryVolume().VolumeSpaceSize)
+
+		// the system area is kept outside of the partition table
+		if hybrid {
+			assert.Equal(t, byte(0xfa), data[0])
+			assert.Equal(t, label[1:mbrBootCodeSize], data[1:mbrBootCodeSize])
+			// the 64-bit boot image location replaces the template
+			catalog, err := image.BootCatalog()
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint64(catalog.Sections[0].Entries[0].LoadRBA)*4, binary.LittleEndian.Uint64(data[mbrBootCodeSize:]))
+			}
+		} else {
+			assert.Equal(t, label[:mbrPartitionTable], data[:mbrPartitionTable])
+		}
+		assert.Equal(t, label[512:], data[512:systemAreaSize])
+
+		// appended partitions follow the files
+		f, err := image.Lookup("data.bin")
+		assert.NoError(t, err)
+		table := data[mbrPartitionTable:]
+		if hybrid {
+			// the isohybrid partition ends where appended partitions start
+			assert.Equal(t, binary.LittleEndian.Uint32(table[16+8:]), binary.LittleEndian.Uint32(table[12:16]))
+			assert.Zero(t, binary.LittleEndian.Uint32(table[12:16])%2048, "partition rounded to a full MiB")
+			table = table[16:]
+		}
+		for n, pType := range []byte{0x83, mbrPartitionEFI} {
+			entry := table[16*n : 16*(n+1)]
+			assert.Equal(t, pType, entry[4])
+			start := binary.LittleEndian.Uint32(entry[8:12])
+			assert.True(t, start > uint32(f.de.ExtentLocation)*4)
+			assert.Equal(t, uint32(len(parts[n])+511)/512, binary.LittleEndian.Uint32(entry[12:16]))
+			assert.Equal(t, parts[n], data[start*512:start*512+uint32(len(parts[n]))])
+		}
+		// the last partition ends the image
+		last := table[16:32]
+		end := binary.LittleEndian.Uint32(last[8:12]) + binary.LittleEndian.Uint32(last[12:16])
+		assert.Equal(t, len(data)/2048, int(end+3)/4)
+	}
+
+	// appended partitions are described by GPT
+	w := newBootTestWriter(t)
+	item, err := NewItemReader(bytes.NewReader(parts[0]))
+	assert.NoError(t, err)
+	assert.NoError(t, w.AppendPartition(item, 0x83))
+	w.GPT = &GPT{}
+	data, image := writeTestImage(t, w)
+	if image != nil {
+		entries := checkGPTHeader(t, data, data[512:1024])
+		assert.Equal(t, gptTypeBasicData[:], entries[0:16])
+		start := binary.LittleEndian.Uint64(entries[32:40]) * 512
+		assert.Equal(t, parts[0], data[start:start+uint64(len(parts[0]))])
+	}
+
+	w = newBootTestWriter(t)
+	sa, err := NewItemReader(bytes.NewReader(make([]byte, systemAreaSize+1)))
+	assert.NoError(t, err)
+	w.SystemArea = sa
+	assert.Equal(t, ErrSystemAreaTooLarge, w.WriteTo(&bytes.Buffer{}))
+	assert.Error(t, w.AppendPartition(item, 0))
+}
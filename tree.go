@@ -0,0 +1,293 @@
+package iso9660
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// maxSymlinkDepth is the maximum number of directory symbolic links followed
+// in a row when adding a tree, to protect against loops
+const maxSymlinkDepth = 16
+
+// SymlinkPolicy defines how symbolic links are handled when adding a tree
+type SymlinkPolicy int
+
+const (
+	// SymlinkDefault preserves symbolic links if Rock Ridge is enabled, and
+	// follows them otherwise
+	SymlinkDefault SymlinkPolicy = iota
+	// SymlinkFollow stores the target of symbolic links in place of the link
+	SymlinkFollow
+	// SymlinkSkip ignores symbolic links
+	SymlinkSkip
+	// SymlinkPreserve stores symbolic links as such, which requires Rock Ridge
+	SymlinkPreserve
+)
+
+// TreeOption is an option that can be passed to AddFS and AddLocalDirectory
+type TreeOption func(*treeOptions)
+
+type treeOptions struct {
+	include  []string
+	exclude  []string
+	symlinks SymlinkPolicy
+}
+
+// Include only adds files whose name or path relative to the tree root
+// matches one of the given patterns, using path.Match syntax. Directories are
+// then only created if they contain matching files.
+func Include(patterns ...string) TreeOption {
+	return func(o *treeOptions) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// Exclude skips files and directories whose name or path relative to the tree
+// root matches one of the given patterns, using path.Match syntax.
+func Exclude(patterns ...string) TreeOption {
+	return func(o *treeOptions) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// Symlinks sets the policy used for symbolic links
+func Symlinks(policy SymlinkPolicy) TreeOption {
+	return func(o *treeOptions) {
+		o.symlinks = policy
+	}
+}
+
+// matchAny returns true if name or the base name of name match any pattern
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// treeWalker holds the state of a tree being added to an image
+type treeWalker struct {
+	iw    *ImageWriter
+	opts  treeOptions
+	local string // local directory the tree comes from, if any
+}
+
+// AddDirectory adds a directory to the image, along with any missing parent.
+// This is only needed for empty directories, as AddFile creates directories
+// as needed.
+func (iw *ImageWriter) AddDirectory(dirPath string) error {
+	segments := splitPath(path.Clean(dirPath))
+	if err := iw.checkPath(segments, true); err != nil {
+		return err
+	}
+	iw.changes++
+	_, err := iw.root.getDir(segments)
+	return err
+}
+
+// AddFS adds all the files and directories of fsys to the image, under prefix.
+// File contents are only read when the image is written.
+//
+// Symbolic links can only be preserved if fsys implements a ReadLink method,
+// such as fs.ReadLinkFS.
+func (iw *ImageWriter) AddFS(fsys fs.FS, prefix string, opts ...TreeOption) error {
+	t := &treeWalker{iw: iw}
+	for _, opt := range opts {
+		opt(&t.opts)
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	return t.walk(fsys, ".", prefix, 0)
+}
+
+// AddLocalDirectory adds the local directory root and all its contents to the
+// image, under target. File contents are only read when the image is written,
+// and attributes are taken from the local files.
+func (iw *ImageWriter) AddLocalDirectory(root, target string, opts ...TreeOption) error {
+	st, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("unable to add local directory: %w", err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("unable to add local directory: %s is not a directory", root)
+	}
+
+	t := &treeWalker{iw: iw, local: root}
+	for _, opt := range opts {
+		opt(&t.opts)
+	}
+	if err := t.validate(); err != nil {
+		return err
+	}
+	return t.walk(os.DirFS(root), ".", target, 0)
+}
+
+// validate checks the options of the walker
+func (t *treeWalker) validate() error {
+	for _, p := range append(append([]string{}, t.opts.include...), t.opts.exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+
+	switch t.opts.symlinks {
+	case SymlinkDefault:
+		if t.iw.RockRidge {
+			t.opts.symlinks = SymlinkPreserve
+		} else {
+			t.opts.symlinks = SymlinkFollow
+		}
+	case SymlinkPreserve:
+		if !t.iw.RockRidge {
+			return ErrRockRidgeRequired
+		}
+	}
+	return nil
+}
+
+// walk adds the contents of dir, found in fsys, to the image under target.
+// depth is the number of directory symbolic links followed to get there.
+func (t *treeWalker) walk(fsys fs.FS, dir, target string, depth int) error {
+	return fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// names are relative to the root of the tree, even when following a
+		// symbolic link
+		if name != dir && matchAny(t.opts.exclude, name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		filePath := path.Join(target, relPath(dir, name))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if len(t.opts.include) > 0 {
+				return nil
+			}
+			return t.addDirectory(info, filePath)
+		case d.Type()&fs.ModeSymlink != 0:
+			return t.addSymlink(fsys, name, info, filePath, depth)
+		case !d.Type().IsRegular():
+			if !t.iw.RockRidge || !t.included(name) {
+				return nil
+			}
+			item := &itemNode{}
+			item.m.attr = attributesFromFileInfo(info)
+			return t.iw.addItem(item, filePath)
+		}
+
+		if !t.included(name) {
+			return nil
+		}
+		return t.addFile(fsys, name, info, filePath)
+	})
+}
+
+// relPath returns name relative to dir, name being dir or one of its
+// descendants
+func relPath(dir, name string) string {
+	switch {
+	case name == dir:
+		return ""
+	case dir == ".":
+		return name
+	default:
+		return name[len(dir)+1:]
+	}
+}
+
+// included returns true if the file should be added
+func (t *treeWalker) included(name string) bool {
+	return len(t.opts.include) == 0 || matchAny(t.opts.include, name)
+}
+
+func (t *treeWalker) addDirectory(info fs.FileInfo, filePath string) error {
+	if err := t.iw.AddDirectory(filePath); err != nil {
+		return err
+	}
+	return t.iw.SetAttributes(filePath, *attributesFromFileInfo(info))
+}
+
+func (t *treeWalker) addFile(fsys fs.FS, name string, info fs.FileInfo, filePath string) error {
+	var item Item
+	if t.local != "" {
+		item = &filepathHndlr{path: filepath.Join(t.local, filepath.FromSlash(name)), st: info}
+	} else {
+		item = &fsHndlr{fsys: fsys, name: name, size: info.Size()}
+	}
+	item.meta().attr = attributesFromFileInfo(info)
+	return t.iw.addItem(item, filePath)
+}
+
+// readLinkFS is implemented by file systems supporting symbolic links, such as
+// fs.ReadLinkFS
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+func (t *treeWalker) addSymlink(fsys fs.FS, name string, info fs.FileInfo, filePath string, depth int) error {
+	switch t.opts.symlinks {
+	case SymlinkSkip:
+		return nil
+	case SymlinkPreserve:
+		if !t.included(name) {
+			return nil
+		}
+
+		var (
+			target string
+			err    error
+		)
+		if t.local != "" {
+			target, err = os.Readlink(filepath.Join(t.local, filepath.FromSlash(name)))
+		} else if rl, ok := fsys.(readLinkFS); ok {
+			target, err = rl.ReadLink(name)
+		} else {
+			err = errors.New("file system does not support reading symbolic links")
+		}
+		if err != nil {
+			return fmt.Errorf("reading symbolic link %s: %w", name, err)
+		}
+
+		if err = t.iw.AddSymlink(target, filePath); err != nil {
+			return err
+		}
+		return t.iw.SetAttributes(filePath, *attributesFromFileInfo(info))
+	}
+
+	// follow the link
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return fmt.Errorf("following symbolic link %s: %w", name, err)
+	}
+
+	if info.IsDir() {
+		if depth >= maxSymlinkDepth {
+			return fmt.Errorf("following symbolic link %s: too many levels of symbolic links", name)
+		}
+		return t.walk(fsys, name, filePath, depth+1)
+	}
+	if !t.included(name) {
+		return nil
+	}
+	return t.addFile(fsys, name, info, filePath)
+}
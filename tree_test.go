@@ -0,0 +1,125 @@
+package iso9660
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// imageFiles writes w and returns the list of paths found in the image
+func imageFiles(t *testing.T, w *ImageWriter) (*Image, []string) {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, w.WriteTo(buf))
+
+	image, err := OpenImage(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+
+	var res []string
+	err = fs.WalkDir(image, ".", func(name string, d fs.DirEntry, err error) error {
+		if name != "." {
+			if d.IsDir() {
+				name += "/"
+			}
+			res = append(res, name)
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	sort.Strings(res)
+	return image, res
+}
+
+func TestAddFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"boot/grub/grub.cfg":      {Data: []byte("menuentry")},
+		"boot/vmlinuz":            {Data: []byte("kernel"), Mode: 0755},
+		"boot/vmlinuz.orig":       {Data: []byte("backup")},
+		"empty":                   {Mode: fs.ModeDir | 0700},
+		"docs/README.md":          {Data: []byte("readme")},
+		"docs/.git/HEAD":          {Data: []byte("ref")},
+		"docs/internal/notes.txt": {Data: []byte("notes")},
+	}
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	assert.NoError(t, w.AddFS(fsys, "media", Exclude("*.orig", ".git", "docs/internal")))
+
+	image, files := imageFiles(t, w)
+	assert.Equal(t, []string{
+		"media/",
+		"media/boot/",
+		"media/boot/grub/",
+		"media/boot/grub/grub.cfg",
+		"media/boot/vmlinuz",
+		"media/docs/",
+		"media/docs/README.md",
+		"media/empty/",
+	}, files)
+
+	data, err := image.ReadFile("media/boot/vmlinuz")
+	assert.NoError(t, err)
+	assert.Equal(t, "kernel", string(data))
+
+	st, err := image.Stat("media/empty")
+	assert.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0700, st.Mode())
+
+	// include patterns only create directories holding matching files
+	w, err = NewWriter()
+	assert.NoError(t, err)
+	w.RockRidge = true
+	assert.NoError(t, w.AddFS(fsys, "", Include("*.cfg", "docs/*.md")))
+
+	_, files = imageFiles(t, w)
+	assert.Equal(t, []string{"boot/", "boot/grub/", "boot/grub/grub.cfg", "docs/", "docs/README.md"}, files)
+
+	assert.Error(t, w.AddFS(fsys, "", Include("[")))
+}
+
+func TestAddLocalDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iso9660_tree")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "src/lib"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "src/empty"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "src/lib/libfoo.so.1"), []byte("elf"), 0644))
+	assert.NoError(t, os.Symlink("libfoo.so.1", filepath.Join(dir, "src/lib/libfoo.so")))
+	assert.NoError(t, os.Symlink("lib", filepath.Join(dir, "src/lib64")))
+
+	for _, testcase := range []struct {
+		policy    SymlinkPolicy
+		rockRidge bool
+		files     []string
+	}{
+		{SymlinkDefault, true, []string{"empty/", "lib/", "lib/libfoo.so", "lib/libfoo.so.1", "lib64"}},
+		{SymlinkSkip, true, []string{"empty/", "lib/", "lib/libfoo.so.1"}},
+		{SymlinkFollow, true, []string{"empty/", "lib/", "lib/libfoo.so", "lib/libfoo.so.1", "lib64/", "lib64/libfoo.so", "lib64/libfoo.so.1"}},
+	} {
+		w, err := NewWriter()
+		assert.NoError(t, err)
+		w.RockRidge = testcase.rockRidge
+
+		assert.NoError(t, w.AddLocalDirectory(filepath.Join(dir, "src"), "", Symlinks(testcase.policy)))
+		image, files := imageFiles(t, w)
+		assert.Equal(t, testcase.files, files)
+
+		if testcase.policy == SymlinkDefault {
+			st, err := image.Stat("lib64")
+			assert.NoError(t, err)
+			assert.Equal(t, "lib", st.Sys().(*RockRidgeInfo).SymlinkTarget)
+		}
+	}
+
+	w, err := NewWriter()
+	assert.NoError(t, err)
+	assert.Equal(t, ErrRockRidgeRequired, w.AddLocalDirectory(dir, "", Symlinks(SymlinkPreserve)))
+}
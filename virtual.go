@@ -0,0 +1,149 @@
+package iso9660
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// VirtualImage is an image laid out by an ImageWriter, whose contents are
+// generated as they are read: descriptors, directories and tables are kept
+// in memory, while the contents of files are read from their items. It can
+// be served over HTTP with Range requests:
+//
+//	img, err := writer.Finalize()
+//	defer img.Close()
+//	http.ServeContent(rw, req, "image.iso", time.Now(), io.NewSectionReader(img, 0, img.Size()))
+type VirtualImage struct {
+	size    int64
+	extents []*virtualExtent
+}
+
+// virtualExtent is the contents of an item within a virtual image, opened
+// when first read
+type virtualExtent struct {
+	start int64 // offset in the image
+	size  int64
+	item  Item
+
+	once sync.Once
+	f    itemFile
+	err  error
+}
+
+// file returns the opened item of the extent
+func (e *virtualExtent) file() (itemFile, error) {
+	e.once.Do(func() {
+		e.f, e.err = e.item.open()
+	})
+	return e.f, e.err
+}
+
+// Finalize lays out the image and returns it as a VirtualImage, without
+// reading the contents of files. The VirtualImage must be closed once read.
+func (iw *ImageWriter) Finalize() (*VirtualImage, error) {
+	wc, err := iw.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(wc.area)+len(wc.vd)*int(sectorSize))
+	header = append(header, wc.area...)
+	for _, vd := range wc.vd {
+		data, err := vd.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, data...)
+	}
+
+	res := &VirtualImage{
+		size:    int64(wc.freeSectorPointer) * int64(sectorSize),
+		extents: []*virtualExtent{{size: int64(len(header)), item: &bufferHndlr{d: header}}},
+	}
+	for _, item := range wc.items {
+		if item.Size() == 0 {
+			continue
+		}
+		res.extents = append(res.extents, &virtualExtent{
+			start: int64(item.meta().targetSector) * int64(sectorSize),
+			size:  item.Size(),
+			item:  item,
+		})
+	}
+	return res, nil
+}
+
+// Size returns the size of the image in bytes
+func (v *VirtualImage) Size() int64 {
+	return v.size
+}
+
+// ReadAt reads the contents of the image at offset off. It can be called
+// concurrently.
+func (v *VirtualImage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) && off < v.size {
+		// first extent ending after off
+		i := sort.Search(len(v.extents), func(i int) bool {
+			return v.extents[i].start+v.extents[i].size > off
+		})
+
+		var e *virtualExtent
+		end := v.size
+		if i < len(v.extents) {
+			if e = v.extents[i]; e.start > off {
+				// padding up to the next extent
+				end, e = e.start, nil
+			} else {
+				end = e.start + e.size
+			}
+		}
+
+		buf := p[n:]
+		if int64(len(buf)) > end-off {
+			buf = buf[:end-off]
+		}
+
+		m := 0
+		if e != nil {
+			f, err := e.file()
+			if err != nil {
+				return n, err
+			}
+			if m, err = f.ReadAt(buf, off-e.start); err != nil && err != io.EOF {
+				return n + m, err
+			}
+		}
+		// padding, or a file shorter than its item's size
+		for j := m; j < len(buf); j++ {
+			buf[j] = 0
+		}
+
+		n += len(buf)
+		off += int64(len(buf))
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the files opened while reading the image
+func (v *VirtualImage) Close() error {
+	var err error
+	for _, e := range v.extents {
+		if e.f != nil {
+			if cerr := e.f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package iso9660
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newVirtualTestWriter returns a writer with all kinds of items, always
+// producing the same image
+func newVirtualTestWriter(t *testing.T, dir string) *ImageWriter {
+	w := newBootTestWriter(t)
+	w.Joliet = true
+	w.RockRidge = true
+	w.IsoHybrid = &IsoHybrid{BootCode: []byte{0xfa}}
+	w.GPT = &GPT{DiskGUID: [16]byte{1}}
+	now := VolumeDescriptorTimestampFromTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	w.Primary.VolumeCreationDateAndTime = now
+	w.Primary.VolumeModificationDateAndTime = now
+	w.Primary.VolumeEffectiveDateAndTime = now
+
+	efi, err := NewItemReader(bytes.NewReader(bytes.Repeat([]byte("EFI"), 2000)))
+	assert.NoError(t, err)
+	assert.NoError(t, w.AddBootEntry(&BootCatalogEntry{Platform: ElToritoEFI}, efi, "efi.img"))
+
+	assert.NoError(t, w.AddFile(strings.NewReader("hello world"), "hello.txt"))
+	assert.NoError(t, w.AddFile(bytes.NewReader(bytes.Repeat([]byte("0123456789"), 1000)), "dir/numbers.txt"))
+	assert.NoError(t, w.AddLocalFile(filepath.Join(dir, "local.txt"), "dir/local.txt"))
+	assert.NoError(t, w.AddFS(fstest.MapFS{
+		"fs/a.txt": {Data: bytes.Repeat([]byte("a"), 5000)},
+		"fs/b.txt": {Data: []byte("b")},
+	}, "fs"))
+	concat := NewItemConcat(&bufferHndlr{d: []byte("con")}, &bufferHndlr{d: []byte("cat")})
+	assert.NoError(t, w.AddFile(concat, "concat.txt"))
+	return w
+}
+
+func TestWriterFinalize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iso9660_virtual")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "local.txt"), bytes.Repeat([]byte("local "), 3000), 0644))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, newVirtualTestWriter(t, dir).WriteTo(buf))
+	expected := buf.Bytes()
+
+	img, err := newVirtualTestWriter(t, dir).Finalize()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer img.Close()
+	assert.Equal(t, int64(len(expected)), img.Size())
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+
+	// concurrent reads at random offsets
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 100; j++ {
+				off := r.Int63n(img.Size())
+				p := make([]byte, r.Intn(10000))
+				n, err := img.ReadAt(p, off)
+				if off+int64(len(p)) > img.Size() {
+					assert.Equal(t, io.EOF, err)
+				} else {
+					assert.NoError(t, err)
+				}
+				assert.True(t, bytes.Equal(expected[off:off+int64(n)], p[:n]))
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	n, err := img.ReadAt(make([]byte, 10), img.Size())
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	// the image can be read back
+	image, err := OpenImage(img)
+	assert.NoError(t, err)
+	f, err := image.Lookup("dir/local.txt")
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadAll(f.Reader())
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte("local "), 3000), content)
+	}
+}